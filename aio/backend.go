@@ -0,0 +1,311 @@
+package aio
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pawelgaczynski/giouring"
+	"golang.org/x/sys/unix"
+)
+
+// Backend selects the loop implementation.
+type Backend int
+
+const (
+	// BackendAuto uses io_uring if it is available and supports all required
+	// operations, epoll otherwise.
+	BackendAuto Backend = iota
+	// BackendIOUring uses io_uring, New fails if it is not available.
+	BackendIOUring
+	// BackendEpoll uses epoll and non-blocking syscalls. It is slower than
+	// io_uring but works on kernels without io_uring or where it is disabled.
+	BackendEpoll
+)
+
+func (b Backend) String() string {
+	switch b {
+	case BackendAuto:
+		return "auto"
+	case BackendIOUring:
+		return "io_uring"
+	case BackendEpoll:
+		return "epoll"
+	}
+	return fmt.Sprintf("Backend(%d)", int(b))
+}
+
+// ring is submission and completion queue used by the loop. Implemented by
+// giouring.Ring and by the epoll emulation of it.
+type ring interface {
+	GetSQE() *giouring.SubmissionQueueEntry
+	SubmitAndWait(waitNr uint32) (uint, error)
+	WaitCQEs(waitNr uint32, ts *syscall.Timespec, sigmask *unix.Sigset_t) (*giouring.CompletionQueueEvent, error)
+	PeekBatchCQE(cqes []*giouring.CompletionQueueEvent) uint32
+	CQAdvance(numberOfCQEs uint32)
+	SetupBufRing(entries uint32, group int, flags uint32) (*giouring.BufAndRing, error)
+	QueueExit()
+}
+
+// requiredOps are io_uring operations used by the loop
+var requiredOps = map[uint8]string{
+	giouring.OpAccept:      "accept",
+	giouring.OpAsyncCancel: "async_cancel",
+	giouring.OpClose:       "close",
+	giouring.OpConnect:     "connect",
+	giouring.OpOpenat:      "openat",
+	giouring.OpRead:        "read",
+	giouring.OpRecv:        "recv",
+	giouring.OpRecvmsg:     "recvmsg",
+	giouring.OpSend:        "send",
+	giouring.OpSendmsg:     "sendmsg",
+	giouring.OpShutdown:    "shutdown",
+	giouring.OpSocket:      "socket",
+	giouring.OpSplice:      "splice",
+	giouring.OpTimeout:     "timeout",
+	giouring.OpWritev:      "writev",
+}
+
+// requiredKernel is the first kernel with multishot accept and provided
+// buffer rings used by the loop. Probe detects only operations, not their
+// modes, so these are gated on the kernel version.
+var requiredKernel = kernelVersion{5, 19}
+
+// multishotRecvKernel is the first kernel with multishot recv and recvmsg.
+var multishotRecvKernel = kernelVersion{6, 0}
+
+// UnsupportedError is returned from New when io_uring is missing operations
+// or features required by the loop. Use BackendAuto or BackendEpoll on such
+// kernels.
+type UnsupportedError struct {
+	Missing []string // names of the missing operations and features
+}
+
+func (e *UnsupportedError) Error() string {
+	return "io_uring missing required operations or features: " + strings.Join(e.Missing, ", ")
+}
+
+func (e *UnsupportedError) Unwrap() error {
+	return errors.ErrUnsupported
+}
+
+// features are optional io_uring capabilities
+type features struct {
+	// Multishot recv and recvmsg, without them recv is re-armed after each
+	// completion. Gated on the kernel version, see multishotRecvKernel.
+	multishotRecv bool
+	// Registered files table, enabled by Options.FixedFiles.
+	fixedFiles bool
+	// Zero copy send operation, io_uring only.
+	sendZC bool
+}
+
+// initRing creates io_uring or epoll ring depending on the options backend.
+func (l *Loop) initRing(opt Options) error {
+	switch opt.Backend {
+	case BackendEpoll:
+		return l.initEpoll(opt)
+	case BackendIOUring:
+		return l.initIOUring(opt)
+	}
+	err := l.initIOUring(opt)
+	if err == nil {
+		return nil
+	}
+	var errno syscall.Errno
+	var unsupported *UnsupportedError
+	if !errors.As(err, &errno) && !errors.As(err, &unsupported) {
+		// invalid options
+		return err
+	}
+	slog.Info("io_uring not available, using epoll", "err", err)
+	return l.initEpoll(opt)
+}
+
+func (l *Loop) initEpoll(opt Options) error {
+	r, err := newEpollRing(opt.RingEntries)
+	if err != nil {
+		return err
+	}
+	l.ring = r
+	l.backend = BackendEpoll
+	l.features = features{multishotRecv: true}
+	return nil
+}
+
+// initIOUring creates io_uring with the options setup flags and probes it for
+// the required operations.
+func (l *Loop) initIOUring(opt Options) error {
+	flags, err := opt.setupFlags()
+	if err != nil {
+		return err
+	}
+	var params giouring.Params
+	rp := (*ringParams)(unsafe.Pointer(&params))
+	rp.flags = flags
+	rp.sqThreadIdle = uint32(opt.SQPollIdle / time.Millisecond)
+	r := giouring.NewRing()
+	if err := r.QueueInitParams(opt.RingEntries, &params); err != nil {
+		return fmt.Errorf("io_uring setup: %w", err)
+	}
+	probe, err := r.GetProbeRing()
+	if err != nil {
+		r.QueueExit()
+		return fmt.Errorf("io_uring probe: %w", err)
+	}
+	var missing []string
+	for op, name := range requiredOps {
+		if !probe.IsSupported(op) {
+			missing = append(missing, name)
+		}
+	}
+	kernel := runningKernel()
+	if kernel.less(requiredKernel) {
+		missing = append(missing,
+			"multishot accept (kernel "+requiredKernel.String()+")",
+			"provided buffer rings (kernel "+requiredKernel.String()+")")
+	}
+	if len(missing) > 0 {
+		r.QueueExit()
+		sort.Strings(missing)
+		return &UnsupportedError{Missing: missing}
+	}
+	if opt.FixedFiles > 0 {
+		if _, err := r.RegisterFilesSparse(opt.FixedFiles); err != nil {
+			r.QueueExit()
+			return fmt.Errorf("io_uring register files: %w", err)
+		}
+	}
+	l.ring = r
+	l.backend = BackendIOUring
+	l.features = features{
+		multishotRecv: !kernel.less(multishotRecvKernel),
+		fixedFiles:    opt.FixedFiles > 0,
+		sendZC:        probe.IsSupported(giouring.OpSendZC),
+	}
+	l.disabled = flags&giouring.SetupRDisabled != 0
+	if !l.features.multishotRecv {
+		slog.Info("io_uring without multishot recv", "kernel", kernel.String())
+	}
+	return nil
+}
+
+// ringParams mirrors leading fields of the io_uring_params, giouring.Params
+// fields are not exported.
+type ringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+}
+
+// setupFlags returns io_uring setup flags for the options
+func (opt Options) setupFlags() (uint32, error) {
+	var flags uint32
+	if opt.SQPoll {
+		if opt.CoopTaskrun || opt.DeferTaskrun {
+			return 0, errors.New("io_uring SQPoll can't be combined with CoopTaskrun or DeferTaskrun")
+		}
+		flags |= giouring.SetupSQPoll
+	}
+	if opt.CoopTaskrun {
+		flags |= giouring.SetupCoopTaskrun
+	}
+	if opt.SingleIssuer || opt.DeferTaskrun {
+		// ring is enabled from the thread running the loop
+		flags |= giouring.SetupSingleIssuer | giouring.SetupRDisabled
+	}
+	if opt.DeferTaskrun {
+		flags |= giouring.SetupDeferTaskrun
+	}
+	return flags, nil
+}
+
+// enableRing locks loop goroutine to the current thread and enables ring
+// created disabled. With single issuer only this thread can submit, loop owns
+// the thread until Close.
+func (l *Loop) enableRing() error {
+	if !l.disabled {
+		return nil
+	}
+	runtime.LockOSThread()
+	if _, err := l.ring.(*giouring.Ring).EnableRings(); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("io_uring enable: %w", err)
+	}
+	l.disabled = false
+	l.issuerTid = unix.Gettid()
+	return nil
+}
+
+// releaseThread unlocks thread locked by enableRing. Only the locked
+// goroutine can unlock, if Close is called from another goroutine thread
+// stays locked until loop goroutine exits.
+func (l *Loop) releaseThread() {
+	if l.issuerTid != 0 && l.issuerTid == unix.Gettid() {
+		runtime.UnlockOSThread()
+		l.issuerTid = 0
+	}
+}
+
+// kernelVersion is major and minor version of the linux kernel
+type kernelVersion struct {
+	major, minor int
+}
+
+func (v kernelVersion) less(o kernelVersion) bool {
+	return v.major < o.major || (v.major == o.major && v.minor < o.minor)
+}
+
+func (v kernelVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// runningKernel returns version of the running kernel. If version can't be
+// parsed it is assumed that kernel supports everything.
+func runningKernel() kernelVersion {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return kernelVersion{math.MaxInt, 0}
+	}
+	v, ok := parseKernelVersion(unix.ByteSliceToString(uts.Release[:]))
+	if !ok {
+		return kernelVersion{math.MaxInt, 0}
+	}
+	return v
+}
+
+// parseKernelVersion parses release like "6.1.0-18-amd64"
+func parseKernelVersion(release string) (kernelVersion, bool) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return kernelVersion{}, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return kernelVersion{}, false
+	}
+	minor := parts[1]
+	if i := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minor = minor[:i]
+	}
+	mi, err := strconv.Atoi(minor)
+	if err != nil {
+		return kernelVersion{}, false
+	}
+	return kernelVersion{major, mi}, true
+}
+
+// Backend returns loop implementation in use.
+func (l *Loop) Backend() Backend {
+	return l.backend
+}
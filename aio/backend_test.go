@@ -0,0 +1,130 @@
+package aio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testEcho(t *testing.T, loop *Loop) {
+	ln, err := loop.Listen("127.0.0.1:0", func(fd int, tc *TCPConn) {
+		tc.Bind(&testEchoConn{tc: tc})
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan error)
+	go func() { runDone <- loop.Run(ctx) }()
+
+	data := testRandomBuf(t, 64*1024)
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", ln.Port()), time.Second)
+	require.NoError(t, err)
+	go func() {
+		_, err := conn.Write(data)
+		require.NoError(t, err)
+	}()
+	rsp := make([]byte, len(data))
+	_, err = io.ReadFull(conn, rsp)
+	require.NoError(t, err)
+	require.Equal(t, data, rsp)
+	require.NoError(t, conn.Close())
+
+	cancel()
+	require.NoError(t, <-runDone)
+}
+
+func TestSingleShotRecv(t *testing.T) {
+	opt := testEpollOptions
+	opt.Backend = BackendAuto
+	loop, err := New(opt)
+	require.NoError(t, err)
+	defer loop.Close()
+	if loop.Backend() != BackendIOUring {
+		t.Skip("io_uring not available")
+	}
+	require.True(t, loop.features.multishotRecv)
+	// as on kernel without multishot recv
+	loop.features.multishotRecv = false
+	testEcho(t, loop)
+
+	// udp, single-shot recvmsg buffer has no recvmsg out header
+	server := &testUDPConn{echo: true}
+	server.uc, err = loop.ListenUDP("127.0.0.1:0", server)
+	require.NoError(t, err)
+	client := &testUDPConn{}
+	client.uc, err = loop.DialUDP(server.uc.LocalAddr().String(), client)
+	require.NoError(t, err)
+	clientAddr := client.uc.LocalAddr()
+	data := [][]byte{[]byte("foo"), testRandomBuf(t, 512)}
+	client.onReceived = func() {
+		if len(client.received) == len(data) {
+			client.uc.Close()
+			server.uc.Close()
+		}
+	}
+	for _, d := range data {
+		client.uc.Send(d)
+	}
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, data, client.received)
+	require.Equal(t, data, server.received)
+	require.Equal(t, clientAddr, server.from)
+}
+
+func TestSetupOptions(t *testing.T) {
+	opt := testEpollOptions
+	opt.Backend = BackendIOUring
+	opt.SQPoll = true
+	opt.DeferTaskrun = true
+	_, err := New(opt)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, errors.ErrUnsupported))
+
+	for _, setup := range []func(*Options){
+		func(o *Options) { o.SingleIssuer = true },
+		func(o *Options) { o.CoopTaskrun, o.DeferTaskrun = true, true },
+		func(o *Options) { o.SQPoll, o.SQPollIdle = true, 10*time.Millisecond },
+	} {
+		opt := testEpollOptions
+		opt.Backend = BackendAuto
+		setup(&opt)
+		loop, err := New(opt)
+		require.NoError(t, err)
+		testEcho(t, loop)
+		loop.Close()
+	}
+}
+
+func TestUnsupportedError(t *testing.T) {
+	err := error(&UnsupportedError{Missing: []string{"socket", "splice"}})
+	require.ErrorIs(t, err, errors.ErrUnsupported)
+	require.Equal(t, "io_uring missing required operations or features: socket, splice", err.Error())
+}
+
+func TestParseKernelVersion(t *testing.T) {
+	for _, c := range []struct {
+		release string
+		v       kernelVersion
+		ok      bool
+	}{
+		{"6.1.0-18-amd64", kernelVersion{6, 1}, true},
+		{"5.19.17", kernelVersion{5, 19}, true},
+		{"6.18.44-fc-v130", kernelVersion{6, 18}, true},
+		{"6.0-rc1", kernelVersion{6, 0}, true},
+		{"6", kernelVersion{}, false},
+		{"x.y", kernelVersion{}, false},
+	} {
+		v, ok := parseKernelVersion(c.release)
+		require.Equal(t, c.ok, ok, c.release)
+		require.Equal(t, c.v, v, c.release)
+	}
+	require.True(t, kernelVersion{5, 15}.less(requiredKernel))
+	require.False(t, kernelVersion{6, 0}.less(multishotRecvKernel))
+	require.False(t, runningKernel().less(kernelVersion{}))
+}
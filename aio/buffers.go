@@ -0,0 +1,203 @@
+package aio
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pawelgaczynski/giouring"
+)
+
+// defaultBufferGroup is group created from Options RecvBuffersCount and
+// RecvBufferLen, used by all connections which don't select other group.
+const defaultBufferGroup = 0
+
+// maxBufRingEntries is kernel limit for number of entries in buffer ring
+const maxBufRingEntries = 32768
+
+// BufferGroup describes additional group of provided buffers.
+type BufferGroup struct {
+	Count uint32 // number of buffers allocated at start
+	Len   uint32 // length of each buffer
+	// MaxCount enables automatic growth of the group when kernel runs out of
+	// buffers. Group grows by Count buffers up to MaxCount. Zero disables
+	// growth.
+	MaxCount uint32
+}
+
+// BufferStats is usage snapshot of one provided buffers group.
+type BufferStats struct {
+	Group     uint16
+	Len       uint32 // length of each buffer
+	Count     uint32 // number of currently allocated buffers
+	MaxCount  uint32 // maximum number of buffers group can grow to
+	Exhausted uint64 // number of times recv failed with ENOBUFS
+	Grown     uint64 // number of times group was expanded
+}
+
+// #region providedBuffers
+
+// providedBuffers is one group of buffers shared with the kernel through the
+// buffer ring. Buffers are allocated in chunks of chunkLen buffers, buffer id
+// determines chunk and position in chunk.
+type providedBuffers struct {
+	group    uint16
+	br       *giouring.BufAndRing
+	chunks   [][]byte
+	chunkLen uint32 // number of buffers in chunk
+	maxCount uint32 // maximum number of buffers
+	entries  uint32 // buffer ring size, power of 2
+	bufLen   uint32
+
+	// stats, updated in the loop goroutine
+	count     atomic.Uint32
+	exhausted atomic.Uint64
+	grown     atomic.Uint64
+}
+
+func (b *providedBuffers) init(ring ring, group uint16, count, maxCount, bufLen uint32) error {
+	if count == 0 || bufLen == 0 {
+		return fmt.Errorf("buffer group %d: count and len must be positive", group)
+	}
+	if maxCount < count {
+		maxCount = count
+	}
+	maxCount -= maxCount % count // whole chunks only
+	b.group = group
+	b.chunkLen = count
+	b.maxCount = maxCount
+	b.bufLen = bufLen
+	b.entries = roundUpPow2(maxCount)
+	if b.entries > maxBufRingEntries {
+		return fmt.Errorf("buffer group %d: too many buffers %d", group, maxCount)
+	}
+	// share buffers with io_uring
+	var err error
+	b.br, err = ring.SetupBufRing(b.entries, int(group), 0)
+	if err != nil {
+		return err
+	}
+	return b.addChunk()
+}
+
+// addChunk allocates chunkLen new buffers and adds them to the buffer ring.
+func (b *providedBuffers) addChunk() error {
+	// mmap allocated space for all buffers
+	data, err := syscall.Mmap(-1, 0, int(b.chunkLen*b.bufLen),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return err
+	}
+	first := uint32(len(b.chunks)) * b.chunkLen
+	b.chunks = append(b.chunks, data)
+	for i := uint32(0); i < b.chunkLen; i++ {
+		b.br.BufRingAdd(
+			uintptr(unsafe.Pointer(&data[b.bufLen*i])),
+			b.bufLen,
+			uint16(first+i),
+			giouring.BufRingMask(b.entries),
+			int(i),
+		)
+	}
+	b.br.BufRingAdvance(int(b.chunkLen))
+	b.count.Add(b.chunkLen)
+	return nil
+}
+
+// exhaust is called when recv fails with ENOBUFS. Grows group if allowed.
+func (b *providedBuffers) exhaust() {
+	b.exhausted.Add(1)
+	if b.count.Load()+b.chunkLen > b.maxCount {
+		return
+	}
+	if err := b.addChunk(); err != nil {
+		return
+	}
+	b.grown.Add(1)
+}
+
+// get provided buffer from cqe res, flags
+func (b *providedBuffers) get(res int32, flags uint32) ([]byte, uint16) {
+	isProvidedBuffer := flags&giouring.CQEFBuffer > 0
+	if !isProvidedBuffer {
+		panic("missing buffer flag")
+	}
+	bufferID := uint16(flags >> giouring.CQEBufferShift)
+	chunk := b.chunks[uint32(bufferID)/b.chunkLen]
+	start := (uint32(bufferID) % b.chunkLen) * b.bufLen
+	n := uint32(res)
+	return chunk[start : start+n], bufferID
+}
+
+// return provided buffer to the kernel
+func (b *providedBuffers) release(buf []byte, bufferID uint16) {
+	b.br.BufRingAdd(
+		uintptr(unsafe.Pointer(&buf[0])),
+		b.bufLen,
+		uint16(bufferID),
+		giouring.BufRingMask(b.entries),
+		0,
+	)
+	b.br.BufRingAdvance(1)
+}
+
+func (b *providedBuffers) stats() BufferStats {
+	return BufferStats{
+		Group:     b.group,
+		Len:       b.bufLen,
+		Count:     b.count.Load(),
+		MaxCount:  b.maxCount,
+		Exhausted: b.exhausted.Load(),
+		Grown:     b.grown.Load(),
+	}
+}
+
+func (b *providedBuffers) deinit() {
+	for _, data := range b.chunks {
+		_ = syscall.Munmap(data)
+	}
+	b.chunks = nil
+}
+
+//#endregion providedBuffers
+
+// initBuffers creates default and all additional buffer groups. On error
+// caller releases already created groups with deinitBuffers.
+func (l *Loop) initBuffers(opt Options) error {
+	groups := append([]BufferGroup{{
+		Count:    opt.RecvBuffersCount,
+		Len:      opt.RecvBufferLen,
+		MaxCount: opt.RecvBuffersMaxCount,
+	}}, opt.BufferGroups...)
+	for i, g := range groups {
+		b := &providedBuffers{}
+		l.buffers = append(l.buffers, b)
+		if err := b.init(l.ring, uint16(i), g.Count, g.MaxCount, g.Len); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Loop) deinitBuffers() {
+	for _, b := range l.buffers {
+		b.deinit()
+	}
+}
+
+// bufferGroup returns provided buffers group by id
+func (l *Loop) bufferGroup(group uint16) (*providedBuffers, error) {
+	if int(group) >= len(l.buffers) {
+		return nil, fmt.Errorf("unknown buffer group %d", group)
+	}
+	return l.buffers[group], nil
+}
+
+func roundUpPow2(v uint32) uint32 {
+	n := uint32(1)
+	for n < v {
+		n <<= 1
+	}
+	return n
+}
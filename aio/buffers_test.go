@@ -0,0 +1,57 @@
+package aio
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferGroupGrow(t *testing.T) {
+	loop, err := New(Options{
+		RingEntries:      16,
+		RecvBuffersCount: 8,
+		RecvBufferLen:    1024,
+		BufferGroups: []BufferGroup{
+			{Count: 2, Len: 64, MaxCount: 16},
+		},
+	})
+	require.NoError(t, err)
+	defer loop.Close()
+
+	server := testConn{}
+	lsn, err := loop.Listen("127.0.0.1:0", func(fd int, tc *TCPConn) {
+		tc.Bind(&server)
+	})
+	require.NoError(t, err)
+	require.Error(t, lsn.SetBufferGroup(2))
+	require.NoError(t, lsn.SetBufferGroup(1))
+
+	data := testRandomBuf(t, 256*1024)
+	go func() {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", lsn.Port()))
+		require.NoError(t, err)
+		_, err = conn.Write(data)
+		require.NoError(t, err)
+		conn.Close()
+	}()
+	for !server.closed {
+		require.NoError(t, loop.runOnce())
+	}
+	testRequireEqualBuffers(t, data, server.received)
+
+	stats := loop.Stats().Buffers
+	require.Len(t, stats, 2)
+	require.Equal(t, BufferStats{Group: 0, Len: 1024, Count: 8, MaxCount: 8}, stats[0])
+	bs := stats[1]
+	require.Equal(t, uint32(64), bs.Len)
+	require.Equal(t, uint32(16), bs.MaxCount)
+	require.Greater(t, bs.Exhausted, uint64(0))
+	require.Greater(t, bs.Grown, uint64(0))
+	require.Equal(t, 2+2*uint32(bs.Grown), bs.Count)
+	require.LessOrEqual(t, bs.Count, bs.MaxCount)
+
+	lsn.Close()
+	require.NoError(t, loop.runUntilDone())
+}
@@ -0,0 +1,411 @@
+package aio
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pawelgaczynski/giouring"
+)
+
+// callback fired when tcp connection is dialed
+type Dialed func(fd int, tcpConn *TCPConn, err error)
+
+// Resolver resolves host name to ip addresses. It is called outside of the
+// loop goroutine so it can block. *net.Resolver implements it. If resolver
+// also has LookupPort method it is used for service names.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// defaultFallbackDelay is time to wait for the connection attempt before
+// starting next one, RFC 8305 recommended value.
+const defaultFallbackDelay = 250 * time.Millisecond
+
+// DialConfig are options for the DialContext.
+type DialConfig struct {
+	// Timeout limits time spent in resolve and connect. Zero means no
+	// timeout, dial depends on the operating system timeout.
+	Timeout time.Duration
+	// Socket options are set before connect.
+	Socket SocketOptions
+	// Resolver is used for host names, net.DefaultResolver if not set.
+	Resolver Resolver
+	// FallbackDelay is time to wait for the connection attempt to succeed
+	// before starting attempt to the next resolved address (Happy Eyeballs).
+	// Zero means 250ms.
+	FallbackDelay time.Duration
+}
+
+// Dial connects to the tcp or unix domain socket address. Address formats are
+// same as in Listen, host name can be used instead of ip address.
+func (l *Loop) Dial(addr string, dialed Dialed) error {
+	return l.DialContext(context.Background(), addr, DialConfig{}, dialed)
+}
+
+// DialContext connects to the address. If ctx is done or timeout expires
+// before connection is established dial is canceled. Dialed callback is fired
+// exactly once, with the context error on cancel or ErrTimeout on timeout.
+// Error is returned only if dial is not started, and then dialed callback is
+// not fired.
+//
+// Host and service names are resolved outside of the loop goroutine. All resolved addresses
+// are tried, ip6 and ip4 interleaved, starting with ip6. Next attempt is
+// started when previous fails or after FallbackDelay (RFC 8305 Happy
+// Eyeballs). First established connection wins, others are canceled.
+func (l *Loop) DialContext(ctx context.Context, addr string, cfg DialConfig, dialed Dialed) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d := &dial{
+		loop:          l,
+		dialed:        dialed,
+		socket:        cfg.Socket,
+		fallbackDelay: cfg.FallbackDelay,
+		attempts:      make(map[*attempt]struct{}),
+	}
+	if d.fallbackDelay <= 0 {
+		d.fallbackDelay = defaultFallbackDelay
+	}
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		sa, domain, err := resolveUnixAddr(addr)
+		if err != nil {
+			return err
+		}
+		d.addrs = []dialAddr{{sa: sa, domain: domain}}
+	} else {
+		host, service, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		port, err := strconv.Atoi(service)
+		numericPort := err == nil
+		if numericPort && (port < 0 || port > 0xffff) {
+			return &net.AddrError{Err: "invalid port", Addr: addr}
+		}
+		ip, err := netip.ParseAddr(host)
+		if host == "" {
+			ip, err = netip.IPv6Unspecified(), nil
+		}
+		if err == nil && numericPort {
+			d.port = port
+			d.addrs = d.ipAddrs([]netip.Addr{ip})
+		} else {
+			// resolve host and service name in the other goroutine, post
+			// result to the loop
+			resolver := cfg.Resolver
+			if resolver == nil {
+				resolver = net.DefaultResolver
+			}
+			lookupCtx, cancel := context.WithCancel(ctx)
+			d.stopLookup = cancel
+			lookupHost := err != nil
+			go func() {
+				ips := []netip.Addr{ip}
+				port := port
+				var err error
+				if lookupHost {
+					ips, err = resolver.LookupNetIP(lookupCtx, "ip", host)
+				}
+				if err == nil && !numericPort {
+					port, err = lookupPort(lookupCtx, resolver, service)
+				}
+				l.Post(func() { d.resolved(ips, port, err) })
+			}()
+		}
+	}
+	if cfg.Timeout > 0 {
+		d.timer = l.AfterFunc(cfg.Timeout, func() { d.cancel(ErrTimeout) })
+	}
+	if ctx.Done() != nil {
+		d.stopCtx = context.AfterFunc(ctx, func() {
+			l.Post(func() { d.cancel(ctx.Err()) })
+		})
+	}
+	l.dials[d] = struct{}{}
+	if d.addrs != nil {
+		d.next()
+	}
+	return nil
+}
+
+// lookupPort resolves service name to the tcp port. Resolver is used if it
+// implements LookupPort, as *net.Resolver does.
+func lookupPort(ctx context.Context, resolver Resolver, service string) (int, error) {
+	if r, ok := resolver.(interface {
+		LookupPort(ctx context.Context, network, service string) (int, error)
+	}); ok {
+		return r.LookupPort(ctx, "tcp", service)
+	}
+	return net.DefaultResolver.LookupPort(ctx, "tcp", service)
+}
+
+type dialAddr struct {
+	sa     syscall.Sockaddr
+	domain int
+}
+
+// dial is state of the single dial operation, which can make connection
+// attempts to multiple addresses.
+type dial struct {
+	loop          *Loop
+	dialed        Dialed
+	socket        SocketOptions
+	port          int
+	fallbackDelay time.Duration
+
+	addrs      []dialAddr // not yet tried addresses
+	attempts   map[*attempt]struct{}
+	fallback   *Timer // starts next attempt
+	firstErr   error  // of the failed attempts
+	timer      *Timer
+	stopCtx    func() bool
+	stopLookup context.CancelFunc
+	err        error // cancel reason
+	finished   bool
+}
+
+// ipAddrs sorts addresses as described in RFC 8305 section 4, interleaving
+// address families starting with ip6.
+func (d *dial) ipAddrs(ips []netip.Addr) []dialAddr {
+	var ip6, ip4 []dialAddr
+	for _, ip := range ips {
+		sa, domain := ipSockaddr(net.IP(ip.Unmap().AsSlice()), d.port)
+		if domain == syscall.AF_INET6 {
+			ip6 = append(ip6, dialAddr{sa: sa, domain: domain})
+			continue
+		}
+		ip4 = append(ip4, dialAddr{sa: sa, domain: domain})
+	}
+	addrs := make([]dialAddr, 0, len(ips))
+	for len(ip6) > 0 || len(ip4) > 0 {
+		if len(ip6) > 0 {
+			addrs = append(addrs, ip6[0])
+			ip6 = ip6[1:]
+		}
+		if len(ip4) > 0 {
+			addrs = append(addrs, ip4[0])
+			ip4 = ip4[1:]
+		}
+	}
+	return addrs
+}
+
+// resolved is called in the loop goroutine with the resolver result
+func (d *dial) resolved(ips []netip.Addr, port int, err error) {
+	if d.finished || d.err != nil {
+		return
+	}
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", IsNotFound: true}
+	}
+	if err != nil {
+		d.finish(err)
+		return
+	}
+	d.port = port
+	d.addrs = d.ipAddrs(ips)
+	d.next()
+}
+
+// next starts attempt to the next address and schedules the following one.
+func (d *dial) next() {
+	if d.fallback != nil {
+		d.fallback.Stop()
+		d.fallback = nil
+	}
+	if d.finished || d.err != nil {
+		return
+	}
+	if len(d.addrs) == 0 {
+		if len(d.attempts) == 0 {
+			d.finish(d.firstErr)
+		}
+		return
+	}
+	addr := d.addrs[0]
+	d.addrs = d.addrs[1:]
+	a := &attempt{dial: d, fd: -1}
+	d.attempts[a] = struct{}{}
+	if len(d.addrs) > 0 {
+		d.fallback = d.loop.AfterFunc(d.fallbackDelay, d.next)
+	}
+	a.start(addr)
+}
+
+// attemptFailed is called when connection attempt fails.
+func (d *dial) attemptFailed(a *attempt, err error) {
+	delete(d.attempts, a)
+	if d.finished {
+		return
+	}
+	if d.err != nil {
+		// canceled
+		if len(d.attempts) == 0 {
+			d.finish(d.err)
+		}
+		return
+	}
+	if d.firstErr == nil {
+		d.firstErr = err
+	}
+	d.next()
+}
+
+// connected is called when connection attempt succeeds.
+func (d *dial) connected(a *attempt) {
+	delete(d.attempts, a)
+	l := d.loop
+	fd := a.fd
+	conn := newTcpConn(l, func() { delete(l.connections, fd) }, fd)
+	l.connections[fd] = conn
+	l.stats.dialed.Add(1)
+	d.finish(nil)
+	d.dialed(fd, conn, nil)
+}
+
+// cancel stops dial in progress with the reason err
+func (d *dial) cancel(err error) {
+	if d.finished || d.err != nil {
+		return
+	}
+	d.err = err
+	d.addrs = nil
+	if d.stopLookup != nil {
+		d.stopLookup()
+	}
+	if len(d.attempts) == 0 {
+		// resolve in progress
+		d.finish(err)
+		return
+	}
+	for a := range d.attempts {
+		a.cancel()
+	}
+}
+
+// finish releases dial resources, cancels remaining attempts and fires
+// dialed callback on error.
+func (d *dial) finish(err error) {
+	if d.finished {
+		return
+	}
+	d.finished = true
+	delete(d.loop.dials, d)
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	if d.fallback != nil {
+		d.fallback.Stop()
+	}
+	if d.stopCtx != nil {
+		d.stopCtx()
+	}
+	if d.stopLookup != nil {
+		d.stopLookup()
+	}
+	for a := range d.attempts {
+		a.cancel()
+	}
+	if err != nil {
+		d.dialed(0, nil, err)
+	}
+}
+
+// attempt is connection attempt to the single address
+type attempt struct {
+	dial     *dial
+	fd       int // -1 until socket is created
+	pinner   runtime.Pinner
+	userData uint64 // of the connect operation, zero when not in flight
+	canceled bool
+}
+
+func (a *attempt) start(addr dialAddr) {
+	rawAddr, rawAddrLen, err := sockaddr(addr.sa)
+	if err != nil {
+		a.fail(err)
+		return
+	}
+	a.pinner.Pin(rawAddr)
+	a.dial.loop.prepareStreamSocket(addr.domain, func(res int32, flags uint32, err *ErrErrno) {
+		if err != nil {
+			a.fail(err)
+			return
+		}
+		a.fd = int(res)
+		if a.canceled {
+			a.fail(syscall.ECANCELED)
+			return
+		}
+		if err := a.dial.socket.apply(a.fd, addr.domain); err != nil {
+			a.fail(err)
+			return
+		}
+		a.connect(uintptr(rawAddr), uint64(rawAddrLen))
+	})
+}
+
+func (a *attempt) connect(addr uintptr, addrLen uint64) {
+	a.dial.loop.prepare(a.connectOp(addr, addrLen))
+}
+
+// connectOp prepares connect operation. If attempt is canceled while the
+// operation waits in the loop pending list, nop is prepared instead of
+// connect and attempt fails.
+func (a *attempt) connectOp(addr uintptr, addrLen uint64) operation {
+	l := a.dial.loop
+	cb := func(res int32, flags uint32, err *ErrErrno) {
+		a.userData = 0
+		if err != nil {
+			a.fail(err)
+			return
+		}
+		if a.canceled {
+			// connected after cancel
+			a.fail(syscall.ECANCELED)
+			return
+		}
+		a.pinner.Unpin()
+		a.dial.connected(a)
+	}
+	return func(sqe *giouring.SubmissionQueueEntry) {
+		if a.canceled {
+			sqe.PrepareNop()
+			l.callbacks.set(sqe, func(res int32, flags uint32, err *ErrErrno) {
+				a.fail(syscall.ECANCELED)
+			})
+			return
+		}
+		sqe.PrepareConnect(a.fd, addr, addrLen)
+		l.callbacks.set(sqe, cb)
+		a.userData = sqe.UserData
+	}
+}
+
+func (a *attempt) cancel() {
+	if a.canceled {
+		return
+	}
+	a.canceled = true
+	if a.userData != 0 {
+		a.dial.loop.prepareCancel(a.userData, func(res int32, flags uint32, err *ErrErrno) {})
+	}
+	// if socket is not yet created or connect is still in the loop pending
+	// list, cancel will be noticed in the socket callback or connect op
+}
+
+// fail closes half made socket and reports failure to the dial
+func (a *attempt) fail(err error) {
+	a.pinner.Unpin()
+	if a.fd >= 0 {
+		a.dial.loop.prepareClose(a.fd, func(res int32, flags uint32, err *ErrErrno) {})
+		a.fd = -1
+	}
+	a.dial.attemptFailed(a, err)
+}
@@ -0,0 +1,273 @@
+package aio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testFullBacklogListener returns address of the listener which will not
+// complete any new connection. Listener's backlog is filled with one not
+// accepted connection.
+func testFullBacklogListener(t *testing.T) string {
+	port := testFullBacklogListenerAt(t, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}, syscall.AF_INET)
+	return "127.0.0.1:" + strconv.Itoa(port)
+}
+
+// testFullBacklogListenerAt binds not accepting listener to sa and returns its
+// port.
+func testFullBacklogListenerAt(t *testing.T, sa syscall.Sockaddr, domain int) int {
+	fd, err := syscall.Socket(domain, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { syscall.Close(fd) })
+	require.NoError(t, syscall.Bind(fd, sa))
+	require.NoError(t, syscall.Listen(fd, 0))
+	lsa, err := syscall.Getsockname(fd)
+	require.NoError(t, err)
+	port := sockaddrToAddrPort(lsa).Port()
+
+	// fill backlog
+	for i := 0; i < 2; i++ {
+		cfd, err := syscall.Socket(domain, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK, 0)
+		require.NoError(t, err)
+		t.Cleanup(func() { syscall.Close(cfd) })
+		_ = syscall.Connect(cfd, lsa)
+	}
+	time.Sleep(10 * time.Millisecond)
+	return int(port)
+}
+
+func TestDialTimeout(t *testing.T) {
+	addr := testFullBacklogListener(t)
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	calls := 0
+	start := time.Now()
+	require.NoError(t, loop.DialContext(context.Background(), addr, DialConfig{Timeout: 50 * time.Millisecond},
+		func(fd int, tc *TCPConn, err error) {
+			calls++
+			require.ErrorIs(t, err, ErrTimeout)
+			require.Nil(t, tc)
+		}))
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, 1, calls)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, int64(0), loop.Stats().Connections)
+}
+
+func TestDialContextCancel(t *testing.T) {
+	addr := testFullBacklogListener(t)
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	calls := 0
+	require.NoError(t, loop.DialContext(ctx, addr, DialConfig{Timeout: time.Minute},
+		func(fd int, tc *TCPConn, err error) {
+			calls++
+			require.ErrorIs(t, err, context.Canceled)
+		}))
+	for calls == 0 {
+		require.NoError(t, loop.runOnce())
+	}
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, 1, calls)
+
+	// already done context
+	err = loop.DialContext(ctx, addr, DialConfig{}, func(fd int, tc *TCPConn, err error) {
+		t.Fatal("unexpected dialed callback")
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+// testResolver returns fixed addresses after release is closed
+type testResolver struct {
+	ips     []netip.Addr
+	err     error
+	release chan struct{}
+	hosts   []string
+	ports   map[string]int
+}
+
+func (r *testResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if r.release != nil {
+		<-r.release
+	}
+	r.hosts = append(r.hosts, host)
+	return r.ips, r.err
+}
+
+func (r *testResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	if r.release != nil {
+		<-r.release
+	}
+	port, ok := r.ports[service]
+	if !ok {
+		return 0, &net.DNSError{Err: "unknown port", Name: service, IsNotFound: true}
+	}
+	return port, nil
+}
+
+func TestDialResolveOffLoop(t *testing.T) {
+	listen, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+	port := listen.Addr().(*net.TCPAddr).Port
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	// resolver blocks until loop timer fires, would deadlock if called in the
+	// loop goroutine
+	resolver := &testResolver{ips: []netip.Addr{netip.MustParseAddr("127.0.0.1")}, release: make(chan struct{})}
+	loop.AfterFunc(10*time.Millisecond, func() { close(resolver.release) })
+	var dialErr error
+	require.NoError(t, loop.DialContext(context.Background(), fmt.Sprintf("test.host:%d", port), DialConfig{Resolver: resolver},
+		func(fd int, tc *TCPConn, err error) {
+			dialErr = err
+			if err == nil {
+				tc.Bind(&testConn{})
+				tc.Close()
+			}
+		}))
+	require.NoError(t, loop.runUntilDone())
+	require.NoError(t, dialErr)
+	require.Equal(t, []string{"test.host"}, resolver.hosts)
+
+	// resolver error is passed to the dialed callback
+	resolver = &testResolver{err: errors.New("resolver failed")}
+	require.NoError(t, loop.DialContext(context.Background(), "test.host:80", DialConfig{Resolver: resolver},
+		func(fd int, tc *TCPConn, err error) { dialErr = err }))
+	require.NoError(t, loop.runUntilDone())
+	require.ErrorIs(t, dialErr, resolver.err)
+
+	// service name is also resolved off loop
+	resolver = &testResolver{ports: map[string]int{"test-service": port}, release: make(chan struct{})}
+	loop.AfterFunc(10*time.Millisecond, func() { close(resolver.release) })
+	require.NoError(t, loop.DialContext(context.Background(), "127.0.0.1:test-service", DialConfig{Resolver: resolver},
+		func(fd int, tc *TCPConn, err error) {
+			dialErr = err
+			if err == nil {
+				tc.Bind(&testConn{})
+				tc.Close()
+			}
+		}))
+	require.NoError(t, loop.runUntilDone())
+	require.NoError(t, dialErr)
+	require.Empty(t, resolver.hosts)
+
+	require.NoError(t, loop.DialContext(context.Background(), "127.0.0.1:unknown", DialConfig{Resolver: resolver},
+		func(fd int, tc *TCPConn, err error) { dialErr = err }))
+	require.NoError(t, loop.runUntilDone())
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, dialErr, &dnsErr)
+}
+
+func TestDialCancelPendingConnect(t *testing.T) {
+	port := testFullBacklogListenerAt(t, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}, syscall.AF_INET)
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	calls := 0
+	d := &dial{
+		loop:     loop,
+		attempts: make(map[*attempt]struct{}),
+		dialed: func(fd int, tc *TCPConn, err error) {
+			calls++
+			require.ErrorIs(t, err, context.Canceled)
+		},
+	}
+	loop.dials[d] = struct{}{}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	a := &attempt{dial: d, fd: fd}
+	d.attempts[a] = struct{}{}
+	rawAddr, rawAddrLen, err := sockaddr(&syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: port})
+	require.NoError(t, err)
+	a.pinner.Pin(rawAddr)
+
+	// connect waits in the pending list when dial is canceled, without
+	// dropping it connect to the full backlog listener would never finish
+	loop.pending = append(loop.pending, a.connectOp(uintptr(rawAddr), uint64(rawAddrLen)))
+	d.cancel(context.Canceled)
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, 1, calls)
+	require.Equal(t, -1, a.fd)
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	// ip6 address never completes connection, ip4 listener on the same port
+	// accepts
+	port := testFullBacklogListenerAt(t, &syscall.SockaddrInet6{Addr: netip.IPv6Loopback().As16()}, syscall.AF_INET6)
+	listen, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer listen.Close()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	resolver := &testResolver{ips: []netip.Addr{
+		netip.MustParseAddr("127.0.0.1"),
+		netip.MustParseAddr("::1"),
+	}}
+	start := time.Now()
+	var remote netip.AddrPort
+	cfg := DialConfig{Resolver: resolver, FallbackDelay: 20 * time.Millisecond, Timeout: time.Second}
+	require.NoError(t, loop.DialContext(context.Background(), fmt.Sprintf("test.host:%d", port), cfg,
+		func(fd int, tc *TCPConn, err error) {
+			require.NoError(t, err)
+			sa, err := syscall.Getpeername(fd)
+			require.NoError(t, err)
+			remote = sockaddrToAddrPort(sa)
+			tc.Bind(&testConn{})
+			tc.Close()
+		}))
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, "127.0.0.1", remote.Addr().String())
+	// ip6 is tried first, ip4 after fallback delay
+	require.GreaterOrEqual(t, time.Since(start), cfg.FallbackDelay)
+	require.Equal(t, int64(0), loop.Stats().Connections)
+}
+
+func TestDialAllAddressesFail(t *testing.T) {
+	// get free port without listener
+	listen, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listen.Addr().(*net.TCPAddr).Port
+	listen.Close()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	resolver := &testResolver{ips: []netip.Addr{
+		netip.MustParseAddr("::1"),
+		netip.MustParseAddr("127.0.0.1"),
+	}}
+	calls := 0
+	require.NoError(t, loop.DialContext(context.Background(), fmt.Sprintf("test.host:%d", port), DialConfig{Resolver: resolver},
+		func(fd int, tc *TCPConn, err error) {
+			calls++
+			var errno *ErrErrno
+			require.ErrorAs(t, err, &errno)
+			require.Equal(t, syscall.ECONNREFUSED, errno.Errno)
+		}))
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, 1, calls)
+}
@@ -0,0 +1,679 @@
+package aio
+
+import (
+	"container/heap"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pawelgaczynski/giouring"
+	"golang.org/x/sys/unix"
+)
+
+// maxMultishotBatch is the maximum number of completions multishot operation
+// produces on single readiness notification, others wait for the next one.
+const maxMultishotBatch = 16
+
+// epollRing emulates io_uring submission and completion queues with epoll and
+// non-blocking syscalls. Operations are executed on submit; those which would
+// block wait for the fd readiness and are retried when epoll reports it.
+// Completions have same res and flags as io_uring would produce, so the loop
+// works same on both.
+type epollRing struct {
+	epfd     int
+	sq       []giouring.SubmissionQueueEntry
+	sqTail   int // number of entries returned by GetSQE and not yet submitted
+	cq       []giouring.CompletionQueueEvent
+	cqHead   int
+	fds      map[int]*epollFd
+	timeouts timeoutHeap
+	bufRings map[uint16]*epollBufRing
+	events   [batchSize]unix.EpollEvent
+}
+
+// epollFd is the file descriptor with operations waiting for it readiness
+type epollFd struct {
+	fd         int
+	ops        []*epollOp // in submission order
+	registered uint32     // events registered with epoll, zero if none
+}
+
+type epollOp struct {
+	giouring.SubmissionQueueEntry
+	events   uint32    // EPOLLIN or EPOLLOUT op is waiting for
+	waitFd   int       // fd op is waiting for, Fd or splice input
+	deadline time.Time // of the timeout operation
+}
+
+// epollBufRing is provided buffers ring, buffers are added by the loop to the
+// tail and consumed from the head by recv operations.
+type epollBufRing struct {
+	entries []giouring.BufAndRing
+	mask    uint16
+	head    uint16
+}
+
+func newEpollRing(entries uint32) (*epollRing, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &epollRing{
+		epfd:     epfd,
+		sq:       make([]giouring.SubmissionQueueEntry, entries),
+		fds:      make(map[int]*epollFd),
+		bufRings: make(map[uint16]*epollBufRing),
+	}, nil
+}
+
+// #region ring interface
+
+func (r *epollRing) GetSQE() *giouring.SubmissionQueueEntry {
+	if r.sqTail == len(r.sq) {
+		return nil
+	}
+	sqe := &r.sq[r.sqTail]
+	*sqe = giouring.SubmissionQueueEntry{}
+	r.sqTail++
+	return sqe
+}
+
+func (r *epollRing) SubmitAndWait(waitNr uint32) (uint, error) {
+	submitted := r.submit()
+	return submitted, r.wait(waitNr, -1)
+}
+
+func (r *epollRing) WaitCQEs(waitNr uint32, ts *syscall.Timespec, _ *unix.Sigset_t) (*giouring.CompletionQueueEvent, error) {
+	r.submit()
+	timeout := time.Duration(-1)
+	if ts != nil {
+		timeout = time.Duration(ts.Nano())
+	}
+	if err := r.wait(waitNr, timeout); err != nil {
+		return nil, err
+	}
+	if r.cqHead == len(r.cq) {
+		return nil, nil
+	}
+	return &r.cq[r.cqHead], nil
+}
+
+func (r *epollRing) PeekBatchCQE(cqes []*giouring.CompletionQueueEvent) uint32 {
+	n := 0
+	for ; n < len(cqes) && r.cqHead+n < len(r.cq); n++ {
+		cqes[n] = &r.cq[r.cqHead+n]
+	}
+	return uint32(n)
+}
+
+func (r *epollRing) CQAdvance(numberOfCQEs uint32) {
+	r.cqHead += int(numberOfCQEs)
+	if r.cqHead >= len(r.cq) {
+		r.cq = r.cq[:0]
+		r.cqHead = 0
+	}
+}
+
+func (r *epollRing) SetupBufRing(entries uint32, group int, flags uint32) (*giouring.BufAndRing, error) {
+	br := &epollBufRing{
+		entries: make([]giouring.BufAndRing, entries),
+		mask:    uint16(entries - 1),
+	}
+	r.bufRings[uint16(group)] = br
+	return &br.entries[0], nil
+}
+
+func (r *epollRing) QueueExit() {
+	_ = unix.Close(r.epfd)
+}
+
+// #endregion
+
+// submit executes all prepared operations
+func (r *epollRing) submit() uint {
+	n := r.sqTail
+	for i := 0; i < n; i++ {
+		op := &epollOp{SubmissionQueueEntry: r.sq[i]}
+		r.start(op)
+	}
+	r.sqTail = 0
+	return uint(n)
+}
+
+// wait polls for the fds readiness and expired timeouts until there are
+// waitNr completions or timeout expires. Negative timeout waits forever.
+func (r *epollRing) wait(waitNr uint32, timeout time.Duration) error {
+	var until time.Time
+	if timeout >= 0 {
+		until = time.Now().Add(timeout)
+	}
+	for uint32(len(r.cq)-r.cqHead) < waitNr {
+		deadline := until
+		if len(r.timeouts) > 0 {
+			if next := r.timeouts[0].deadline; deadline.IsZero() || next.Before(deadline) {
+				deadline = next
+			}
+		}
+		msec := -1
+		if !deadline.IsZero() {
+			msec = 0
+			if d := time.Until(deadline); d > 0 {
+				msec = int((d + time.Millisecond - 1) / time.Millisecond)
+			}
+		}
+		n, err := unix.EpollWait(r.epfd, r.events[:], msec)
+		if err != nil {
+			if err != unix.EINTR {
+				return err
+			}
+			n = 0
+		}
+		for _, ev := range r.events[:n] {
+			if f, ok := r.fds[int(ev.Fd)]; ok {
+				r.ready(f, ev.Events)
+			}
+		}
+		r.expireTimeouts()
+		if !until.IsZero() && uint32(len(r.cq)-r.cqHead) < waitNr && !time.Now().Before(until) {
+			return syscall.ETIME
+		}
+	}
+	return nil
+}
+
+func (r *epollRing) complete(userData uint64, res int32, flags uint32) {
+	r.cq = append(r.cq, giouring.CompletionQueueEvent{UserData: userData, Res: res, Flags: flags})
+}
+
+func (r *epollRing) fail(op *epollOp, errno syscall.Errno) {
+	r.complete(op.UserData, -int32(errno), 0)
+}
+
+// #region fd readiness
+
+// start executes operation for the first time
+func (r *epollRing) start(op *epollOp) {
+	switch op.OpCode {
+	case giouring.OpTimeout:
+		r.startTimeout(op)
+		return
+	case giouring.OpAsyncCancel:
+		r.cancel(op)
+		return
+	case giouring.OpClose:
+		r.close(op)
+		return
+	}
+	op.waitFd = int(op.Fd)
+	events := r.execute(op)
+	f, ok := r.fds[op.waitFd]
+	if !ok {
+		return
+	}
+	if events != 0 {
+		op.events = events
+		f.ops = append(f.ops, op)
+	}
+	r.update(f)
+}
+
+// ready retries operations waiting for the fd events
+func (r *epollRing) ready(f *epollFd, events uint32) {
+	if events&(unix.EPOLLERR|unix.EPOLLHUP) != 0 {
+		events |= unix.EPOLLIN | unix.EPOLLOUT
+	}
+	ops := f.ops[:0]
+	for _, op := range f.ops {
+		if op.events&events != 0 {
+			if op.events = r.execute(op); op.events == 0 {
+				continue
+			}
+			if op.waitFd != f.fd {
+				// splice switched between input and output fd
+				wf := r.fd(op.waitFd)
+				wf.ops = append(wf.ops, op)
+				r.update(wf)
+				continue
+			}
+		}
+		ops = append(ops, op)
+	}
+	for i := len(ops); i < len(f.ops); i++ {
+		f.ops[i] = nil
+	}
+	f.ops = ops
+	r.update(f)
+}
+
+// fd returns state of the fd. Fd is switched to the non-blocking mode when
+// first used. State is kept while there are operations waiting for the fd.
+func (r *epollRing) fd(fd int) *epollFd {
+	f, ok := r.fds[fd]
+	if !ok {
+		_ = unix.SetNonblock(fd, true)
+		f = &epollFd{fd: fd}
+		r.fds[fd] = f
+	}
+	return f
+}
+
+// update registers with epoll events required by the waiting operations,
+// forgets fd without them.
+func (r *epollRing) update(f *epollFd) {
+	defer func() {
+		if len(f.ops) == 0 {
+			delete(r.fds, f.fd)
+		}
+	}()
+	var events uint32
+	for _, op := range f.ops {
+		events |= op.events
+	}
+	if events == f.registered {
+		return
+	}
+	var err error
+	switch {
+	case events == 0:
+		err = unix.EpollCtl(r.epfd, unix.EPOLL_CTL_DEL, f.fd, nil)
+	case f.registered == 0:
+		err = unix.EpollCtl(r.epfd, unix.EPOLL_CTL_ADD, f.fd, &unix.EpollEvent{Events: events, Fd: int32(f.fd)})
+	default:
+		err = unix.EpollCtl(r.epfd, unix.EPOLL_CTL_MOD, f.fd, &unix.EpollEvent{Events: events, Fd: int32(f.fd)})
+	}
+	if err != nil {
+		// not pollable fd, fail all waiting operations
+		for _, op := range f.ops {
+			r.fail(op, err.(syscall.Errno))
+		}
+		f.ops = nil
+		events = 0
+	}
+	f.registered = events
+}
+
+// #endregion
+
+// #region operations
+
+// execute runs operation syscall. Returns events to wait for if operation
+// would block, zero when completed.
+func (r *epollRing) execute(op *epollOp) uint32 {
+	fd := uintptr(op.Fd)
+	switch op.OpCode {
+	case giouring.OpNop:
+		r.complete(op.UserData, 0, 0)
+	case giouring.OpSocket:
+		res, _, errno := unix.Syscall(unix.SYS_SOCKET, fd, uintptr(op.Off)|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, uintptr(op.Len))
+		r.result(op, res, errno)
+	case giouring.OpShutdown:
+		_, _, errno := unix.Syscall(unix.SYS_SHUTDOWN, fd, uintptr(op.Len), 0)
+		r.result(op, 0, errno)
+	case giouring.OpOpenat:
+		res, _, errno := unix.Syscall6(unix.SYS_OPENAT, fd, uintptr(op.Addr), uintptr(op.OpcodeFlags)|unix.O_NONBLOCK, uintptr(op.Len), 0, 0)
+		r.result(op, res, errno)
+	case giouring.OpConnect:
+		return r.connect(op)
+	case giouring.OpAccept:
+		return r.accept(op)
+	case giouring.OpRecv:
+		if op.Flags&giouring.SqeBufferSelect != 0 {
+			return r.recvProvided(op)
+		}
+		return r.io(op, unix.EPOLLIN, unix.SYS_RECVFROM, fd, uintptr(op.Addr), uintptr(op.Len), uintptr(op.OpcodeFlags)|unix.MSG_DONTWAIT, 0, 0)
+	case giouring.OpRecvmsg:
+		if op.Flags&giouring.SqeBufferSelect != 0 {
+			return r.recvMsgProvided(op)
+		}
+		return r.io(op, unix.EPOLLIN, unix.SYS_RECVMSG, fd, uintptr(op.Addr), uintptr(op.OpcodeFlags)|unix.MSG_DONTWAIT, 0, 0, 0)
+	case giouring.OpSend:
+		return r.io(op, unix.EPOLLOUT, unix.SYS_SENDTO, fd, uintptr(op.Addr), uintptr(op.Len), uintptr(op.OpcodeFlags)|unix.MSG_DONTWAIT|unix.MSG_NOSIGNAL, 0, 0)
+	case giouring.OpSendmsg:
+		return r.io(op, unix.EPOLLOUT, unix.SYS_SENDMSG, fd, uintptr(op.Addr), uintptr(op.OpcodeFlags)|unix.MSG_DONTWAIT|unix.MSG_NOSIGNAL, 0, 0, 0)
+	case giouring.OpWritev:
+		return r.io(op, unix.EPOLLOUT, unix.SYS_WRITEV, fd, uintptr(op.Addr), uintptr(op.Len), 0, 0, 0)
+	case giouring.OpRead:
+		r.fd(int(op.Fd))
+		if op.Off == ^uint64(0) {
+			return r.io(op, unix.EPOLLIN, unix.SYS_READ, fd, uintptr(op.Addr), uintptr(op.Len), 0, 0, 0)
+		}
+		res, _, errno := unix.Syscall6(unix.SYS_PREAD64, fd, uintptr(op.Addr), uintptr(op.Len), uintptr(op.Off), 0, 0)
+		if errno == unix.ESPIPE {
+			// not seekable, offset is ignored as in io_uring
+			return r.io(op, unix.EPOLLIN, unix.SYS_READ, fd, uintptr(op.Addr), uintptr(op.Len), 0, 0, 0)
+		}
+		if errno == unix.EAGAIN {
+			return unix.EPOLLIN
+		}
+		r.result(op, res, errno)
+	case giouring.OpSplice:
+		return r.splice(op)
+	default:
+		r.fail(op, unix.EINVAL)
+	}
+	return 0
+}
+
+// result completes operation with the syscall result
+func (r *epollRing) result(op *epollOp, res uintptr, errno syscall.Errno) {
+	if errno != 0 {
+		r.fail(op, errno)
+		return
+	}
+	r.complete(op.UserData, int32(res), 0)
+}
+
+// io runs syscall on the non-blocking fd, waits for events if it would block
+func (r *epollRing) io(op *epollOp, events uint32, trap, a1, a2, a3, a4, a5, a6 uintptr) uint32 {
+	r.fd(int(op.Fd))
+	res, _, errno := unix.Syscall6(trap, a1, a2, a3, a4, a5, a6)
+	if errno == unix.EAGAIN {
+		return events
+	}
+	r.result(op, res, errno)
+	return 0
+}
+
+func (r *epollRing) connect(op *epollOp) uint32 {
+	r.fd(int(op.Fd))
+	if op.events == 0 {
+		_, _, errno := unix.Syscall(unix.SYS_CONNECT, uintptr(op.Fd), uintptr(op.Addr), uintptr(op.Off))
+		if errno == unix.EINPROGRESS {
+			return unix.EPOLLOUT
+		}
+		r.result(op, 0, errno)
+		return 0
+	}
+	// connection attempt finished, get its result
+	soErr, err := unix.GetsockoptInt(int(op.Fd), unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		r.fail(op, err.(syscall.Errno))
+		return 0
+	}
+	r.result(op, 0, syscall.Errno(soErr))
+	return 0
+}
+
+func (r *epollRing) accept(op *epollOp) uint32 {
+	r.fd(int(op.Fd))
+	multishot := op.IoPrio&giouring.AcceptMultishot != 0
+	for i := 0; i < maxMultishotBatch; i++ {
+		res, _, errno := unix.Syscall6(unix.SYS_ACCEPT4, uintptr(op.Fd), uintptr(op.Addr), uintptr(op.Off),
+			uintptr(op.OpcodeFlags)|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0, 0)
+		if errno == unix.EAGAIN {
+			return unix.EPOLLIN
+		}
+		if errno != 0 || !multishot {
+			r.result(op, res, errno)
+			return 0
+		}
+		r.complete(op.UserData, int32(res), giouring.CQEFMore)
+	}
+	return unix.EPOLLIN
+}
+
+// recvProvided receives into the buffer from the provided buffers group
+func (r *epollRing) recvProvided(op *epollOp) uint32 {
+	r.fd(int(op.Fd))
+	br := r.bufRings[op.BufIG]
+	multishot := op.IoPrio&giouring.RecvMultishot != 0
+	for i := 0; i < maxMultishotBatch; i++ {
+		buf := br.peek()
+		if buf == nil {
+			r.fail(op, unix.ENOBUFS)
+			return 0
+		}
+		res, _, errno := unix.Syscall6(unix.SYS_RECVFROM, uintptr(op.Fd), uintptr(buf.Addr), uintptr(buf.Len),
+			uintptr(op.OpcodeFlags)|unix.MSG_DONTWAIT, 0, 0)
+		if errno == unix.EAGAIN {
+			return unix.EPOLLIN
+		}
+		if errno != 0 || res == 0 {
+			r.result(op, res, errno)
+			return 0
+		}
+		if !r.provided(op, br, buf, int32(res), multishot) {
+			return 0
+		}
+	}
+	return unix.EPOLLIN
+}
+
+// recvMsgProvided receives datagram into the buffer from the provided buffers
+// group. Buffer layout is same as with io_uring: giouring.RecvmsgOut header,
+// name, control and then payload.
+func (r *epollRing) recvMsgProvided(op *epollOp) uint32 {
+	r.fd(int(op.Fd))
+	br := r.bufRings[op.BufIG]
+	multishot := op.IoPrio&giouring.RecvMultishot != 0
+	tmpl := (*syscall.Msghdr)(pointer(&op.Addr))
+	hdrLen := uint32(unsafe.Sizeof(giouring.RecvmsgOut{}))
+	for i := 0; i < maxMultishotBatch; i++ {
+		buf := br.peek()
+		if buf == nil {
+			r.fail(op, unix.ENOBUFS)
+			return 0
+		}
+		base := pointer(&buf.Addr)
+		payload := hdrLen + tmpl.Namelen + uint32(tmpl.Controllen)
+		if payload > buf.Len {
+			r.fail(op, unix.EFAULT)
+			return 0
+		}
+		iov := syscall.Iovec{Base: (*byte)(unsafe.Add(base, payload))}
+		iov.SetLen(int(buf.Len - payload))
+		msg := syscall.Msghdr{Iov: &iov, Iovlen: 1, Namelen: tmpl.Namelen}
+		if tmpl.Namelen > 0 {
+			msg.Name = (*byte)(unsafe.Add(base, hdrLen))
+		}
+		if tmpl.Controllen > 0 {
+			msg.Control = (*byte)(unsafe.Add(base, hdrLen+tmpl.Namelen))
+			msg.SetControllen(int(tmpl.Controllen))
+		}
+		res, _, errno := unix.Syscall(unix.SYS_RECVMSG, uintptr(op.Fd), uintptr(unsafe.Pointer(&msg)),
+			uintptr(op.OpcodeFlags)|unix.MSG_DONTWAIT)
+		if errno == unix.EAGAIN {
+			return unix.EPOLLIN
+		}
+		if errno != 0 {
+			r.fail(op, errno)
+			return 0
+		}
+		*(*giouring.RecvmsgOut)(base) = giouring.RecvmsgOut{
+			Namelen:    msg.Namelen,
+			ControlLen: uint32(msg.Controllen),
+			PayloadLen: uint32(res),
+			Flags:      uint32(msg.Flags),
+		}
+		if !r.provided(op, br, buf, int32(payload)+int32(res), multishot) {
+			return 0
+		}
+	}
+	return unix.EPOLLIN
+}
+
+// provided completes recv into the provided buffer. Returns true if multishot
+// operation continues.
+func (r *epollRing) provided(op *epollOp, br *epollBufRing, buf *giouring.BufAndRing, res int32, multishot bool) bool {
+	br.head++
+	flags := giouring.CQEFBuffer | uint32(buf.Bid)<<giouring.CQEBufferShift
+	if multishot {
+		flags |= giouring.CQEFMore
+	}
+	r.complete(op.UserData, res, flags)
+	return multishot
+}
+
+func (r *epollRing) splice(op *epollOp) uint32 {
+	fdIn, fdOut := int(op.SpliceFdIn), int(op.Fd)
+	r.fd(fdIn)
+	r.fd(fdOut)
+	var offIn, offOut *int64
+	if off := int64(op.Addr); off != -1 {
+		offIn = &off
+	}
+	if off := int64(op.Off); off != -1 {
+		offOut = &off
+	}
+	n, err := unix.Splice(fdIn, offIn, fdOut, offOut, int(op.Len), int(op.OpcodeFlags)|unix.SPLICE_F_NONBLOCK)
+	var events uint32
+	switch {
+	case err == unix.EAGAIN:
+		// would block on the empty input or on the full output
+		op.waitFd, events = fdOut, unix.EPOLLOUT
+		if !readable(fdIn) {
+			op.waitFd, events = fdIn, unix.EPOLLIN
+		}
+	case err != nil:
+		r.fail(op, err.(syscall.Errno))
+	default:
+		r.complete(op.UserData, int32(n), 0)
+	}
+	// forget state of the fd op is not waiting for
+	for _, fd := range []int{fdIn, fdOut} {
+		if f, ok := r.fds[fd]; ok && (events == 0 || fd != op.waitFd) && len(f.ops) == 0 && f.registered == 0 {
+			delete(r.fds, fd)
+		}
+	}
+	return events
+}
+
+// readable reports whether read from the fd would not block
+func readable(fd int) bool {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 0)
+	return err != nil || (n > 0 && fds[0].Revents != 0)
+}
+
+// close completes operations still waiting for the fd before closing it.
+// Operations are tried once more, after shutdown they will complete.
+func (r *epollRing) close(op *epollOp) {
+	fd := int(op.Fd)
+	if f, ok := r.fds[fd]; ok {
+		for _, wop := range f.ops {
+			if r.execute(wop) != 0 {
+				r.fail(wop, unix.ECANCELED)
+			}
+		}
+		if f.registered != 0 {
+			_ = unix.EpollCtl(r.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+		}
+		delete(r.fds, fd)
+	}
+	_, _, errno := unix.Syscall(unix.SYS_CLOSE, uintptr(fd), 0, 0)
+	r.result(op, 0, errno)
+}
+
+// cancel cancels operation by user data or all operations on the fd
+func (r *epollRing) cancel(op *epollOp) {
+	byFd := op.OpcodeFlags&giouring.AsyncCancelFd != 0
+	all := op.OpcodeFlags&(giouring.AsyncCancelAll|giouring.AsyncCancelAny) != 0
+	match := func(o *epollOp) bool {
+		if byFd {
+			return o.Fd == op.Fd
+		}
+		return o.UserData == op.Addr
+	}
+	canceled := 0
+	cancelFd := func(f *epollFd) {
+		ops := f.ops[:0]
+		for _, o := range f.ops {
+			if (canceled == 0 || all) && match(o) {
+				r.fail(o, unix.ECANCELED)
+				canceled++
+				continue
+			}
+			ops = append(ops, o)
+		}
+		f.ops = ops
+		r.update(f)
+	}
+	if byFd {
+		if f, ok := r.fds[int(op.Fd)]; ok {
+			cancelFd(f)
+		}
+		// splice waiting for the input fd
+		for fd, f := range r.fds {
+			if (canceled == 0 || all) && fd != int(op.Fd) {
+				cancelFd(f)
+			}
+		}
+	} else {
+		for _, f := range r.fds {
+			cancelFd(f)
+			if canceled > 0 {
+				break
+			}
+		}
+		for i := 0; canceled == 0 && i < len(r.timeouts); i++ {
+			if t := r.timeouts[i]; match(t) {
+				heap.Remove(&r.timeouts, i)
+				r.fail(t, unix.ECANCELED)
+				canceled++
+			}
+		}
+	}
+	if canceled == 0 {
+		r.fail(op, unix.ENOENT)
+		return
+	}
+	res := 0
+	if all {
+		res = canceled
+	}
+	r.complete(op.UserData, int32(res), 0)
+}
+
+// #endregion
+
+// #region timeouts
+
+func (r *epollRing) startTimeout(op *epollOp) {
+	ts := (*syscall.Timespec)(pointer(&op.Addr))
+	op.deadline = time.Now().Add(time.Duration(ts.Nano()))
+	heap.Push(&r.timeouts, op)
+}
+
+func (r *epollRing) expireTimeouts() {
+	now := time.Now()
+	for len(r.timeouts) > 0 && !r.timeouts[0].deadline.After(now) {
+		op := heap.Pop(&r.timeouts).(*epollOp)
+		r.fail(op, unix.ETIME)
+	}
+}
+
+// timeoutHeap is min heap of timeout operations by deadline
+type timeoutHeap []*epollOp
+
+func (h timeoutHeap) Len() int           { return len(h) }
+func (h timeoutHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h timeoutHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *timeoutHeap) Push(x any) {
+	*h = append(*h, x.(*epollOp))
+}
+
+func (h *timeoutHeap) Pop() any {
+	old := *h
+	n := len(old)
+	op := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return op
+}
+
+// #endregion
+
+// peek returns buffer at the head of the ring or nil if ring is empty
+func (br *epollBufRing) peek() *giouring.BufAndRing {
+	if br.head == br.entries[0].Tail {
+		return nil
+	}
+	return &br.entries[br.head&br.mask]
+}
+
+// pointer converts address stored in the submission queue entry or buffer
+// ring to the pointer. Addresses are of the pinned or mmaped memory.
+func pointer(addr *uint64) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(addr))
+}
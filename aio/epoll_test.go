@@ -0,0 +1,257 @@
+package aio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testEpollOptions = Options{
+	RingEntries:      16,
+	RecvBuffersCount: 4,
+	RecvBufferLen:    1024,
+	Backend:          BackendEpoll,
+}
+
+func TestEpollEcho(t *testing.T) {
+	loop, err := New(testEpollOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+	require.Equal(t, BackendEpoll, loop.Backend())
+
+	ln, err := loop.Listen("127.0.0.1:0", func(fd int, tc *TCPConn) {
+		tc.Bind(&testEchoConn{tc: tc})
+	})
+	require.NoError(t, err)
+	fired := false
+	loop.AfterFunc(time.Millisecond, func() { fired = true })
+	canceled := loop.AfterFunc(time.Hour, func() { t.Fatal("canceled timer fired") })
+	require.True(t, canceled.Stop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan error)
+	go func() { runDone <- loop.Run(ctx) }()
+
+	// larger than all provided buffers
+	data := testRandomBuf(t, 256*1024)
+	for i := 0; i < 4; i++ {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", ln.Port()), time.Second)
+		require.NoError(t, err)
+		go func() {
+			_, err := conn.Write(data)
+			require.NoError(t, err)
+		}()
+		rsp := make([]byte, len(data))
+		_, err = io.ReadFull(conn, rsp)
+		require.NoError(t, err)
+		require.Equal(t, data, rsp)
+		require.NoError(t, conn.Close())
+	}
+
+	cancel()
+	require.NoError(t, <-runDone)
+	require.True(t, fired)
+	stats := loop.Stats()
+	require.Equal(t, uint64(4), stats.Accepted)
+	require.Equal(t, int64(0), stats.Connections)
+	require.Equal(t, uint64(4*len(data)), stats.BytesReceived)
+}
+
+func TestEpollDial(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+	received := make(chan []byte)
+	go func() {
+		conn, err := listen.Accept()
+		require.NoError(t, err)
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		conn.Close()
+		received <- buf
+	}()
+
+	loop, err := New(testEpollOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	data := testRandomBuf(t, 1024*1024)
+	require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		tc.Bind(&testConn{})
+		require.ErrorIs(t, tc.SetZeroCopy(64*1024), errors.ErrUnsupported)
+		tc.SendFunc(data, func(n int, err error) {
+			require.NoError(t, err)
+			require.Equal(t, len(data), n)
+			tc.Close()
+		})
+	}))
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, data, <-received)
+
+	// connection refused
+	var dialErr error
+	require.NoError(t, loop.Dial("127.0.0.1:1", func(fd int, tc *TCPConn, err error) {
+		dialErr = err
+	}))
+	require.NoError(t, loop.runUntilDone())
+	require.Error(t, dialErr)
+}
+
+func TestEpollUDP(t *testing.T) {
+	loop, err := New(testEpollOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	server := &testUDPConn{echo: true}
+	server.uc, err = loop.ListenUDP("127.0.0.1:0", server)
+	require.NoError(t, err)
+	client := &testUDPConn{}
+	client.uc, err = loop.DialUDP(server.uc.LocalAddr().String(), client)
+	require.NoError(t, err)
+	client.onReceived = func() {
+		if len(client.received) == 2 {
+			client.uc.Close()
+			server.uc.Close()
+		}
+	}
+	clientAddr := client.uc.LocalAddr()
+
+	data := [][]byte{[]byte("foo"), testRandomBuf(t, 512)}
+	for _, d := range data {
+		client.uc.Send(d)
+	}
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, data, client.received)
+	require.Equal(t, data, server.received)
+	require.Equal(t, clientAddr, server.from)
+	require.True(t, client.closed)
+	require.True(t, server.closed)
+}
+
+func TestEpollTimerPost(t *testing.T) {
+	loop, err := New(testEpollOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan error)
+	go func() { runDone <- loop.Run(ctx) }()
+
+	ticks := make(chan struct{}, 3)
+	loop.Post(func() {
+		var ticker *Timer
+		ticker = loop.Ticker(time.Millisecond, func() {
+			ticks <- struct{}{}
+			if len(ticks) == cap(ticks) {
+				ticker.Stop()
+			}
+		})
+	})
+	for i := 0; i < cap(ticks); i++ {
+		<-ticks
+	}
+
+	// post from many goroutines
+	const goroutines, posts = 4, 100
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < posts; j++ {
+				loop.Post(func() { counter++ })
+			}
+		}()
+	}
+	wg.Wait()
+	loop.Post(cancel)
+	require.NoError(t, <-runDone)
+	require.Equal(t, goroutines*posts, counter)
+}
+
+func TestEpollSendFile(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+	received := make(chan []byte)
+	go func() {
+		conn, err := listen.Accept()
+		require.NoError(t, err)
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		conn.Close()
+		received <- buf
+	}()
+
+	path := filepath.Join(t.TempDir(), "file")
+	data := testRandomBuf(t, 1024*1024)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	loop, err := New(testEpollOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	var sent []int
+	require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		tc.Bind(&testConn{})
+		tc.Send([]byte("header"))
+		tc.SendFilePath(path, 0, 0, func(n int, err error) {
+			require.NoError(t, err)
+			sent = append(sent, n)
+			tc.Close()
+		})
+	}))
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, append([]byte("header"), data...), <-received)
+	require.Equal(t, []int{len(data)}, sent)
+}
+
+func TestEpollSpliceWaitsForInput(t *testing.T) {
+	loop, err := New(testEpollOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	var in, out [2]int
+	require.NoError(t, syscall.Pipe2(in[:], syscall.O_CLOEXEC))
+	require.NoError(t, syscall.Pipe2(out[:], syscall.O_CLOEXEC))
+	for _, fd := range append(in[:], out[:]...) {
+		defer syscall.Close(fd)
+	}
+
+	spliced := 0
+	loop.prepareSplice(in[0], -1, out[1], -1, 1024, func(res int32, flags uint32, err *ErrErrno) {
+		require.Nil(t, err)
+		spliced = int(res)
+	})
+	require.NoError(t, loop.submit())
+
+	// empty input pipe, splice waits for the input not the writable output
+	r := loop.ring.(*epollRing)
+	require.Contains(t, r.fds, in[0])
+	require.NotContains(t, r.fds, out[1])
+	require.Equal(t, uint32(syscall.EPOLLIN), r.fds[in[0]].registered)
+
+	_, err = syscall.Write(in[1], []byte("splice"))
+	require.NoError(t, err)
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, 6, spliced)
+	buf := make([]byte, 16)
+	n, err := syscall.Read(out[0], buf)
+	require.NoError(t, err)
+	require.Equal(t, "splice", string(buf[:n]))
+	require.NotContains(t, r.fds, in[0])
+	require.NotContains(t, r.fds, out[1])
+}
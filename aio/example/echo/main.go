@@ -14,8 +14,8 @@ func main() {
 }
 
 func run(addr string) error {
-	// start loop
-	loop, err := aio.New(aio.Options{
+	// start loop in each cpu core
+	group, err := aio.NewGroup(0, aio.Options{
 		RingEntries:      128,
 		RecvBuffersCount: 256,
 		RecvBufferLen:    1024,
@@ -23,22 +23,22 @@ func run(addr string) error {
 	if err != nil {
 		return err
 	}
-	defer loop.Close()
+	defer group.Close()
 
 	// called when tcp listener accepts tcp connection
 	tcpAccepted := func(fd int, tc *aio.TCPConn) {
 		tc.Bind(&conn{fd: fd, sender: tc})
 	}
 
-	// start listener
-	_, err = loop.Listen(addr, tcpAccepted)
+	// start listener in each shard
+	_, err = group.Listen(addr, tcpAccepted)
 	if err != nil {
 		return err
 	}
-	slog.Debug("started server", "addr", addr)
+	slog.Debug("started server", "addr", addr, "shards", len(group.Loops()))
 	// run util interrupted
 	ctx := signal.InterruptContext()
-	if err := loop.Run(ctx); err != nil {
+	if err := group.Run(ctx); err != nil {
 		return err
 	}
 	return nil
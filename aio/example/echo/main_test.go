@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ianic/xnet/aio"
+	"github.com/stretchr/testify/require"
+)
+
+// BenchmarkEcho measures round trip of one message through the echo server.
+// Allocations per op are per echoed message, client side does not allocate.
+// Example conn copies each received buffer; loop variant replies with the
+// preallocated message so only allocations of the loop itself are counted.
+func BenchmarkEcho(b *testing.B) {
+	for _, size := range []int{64, 1024} {
+		b.Run(fmt.Sprintf("example/%dB", size), func(b *testing.B) {
+			benchmarkEcho(b, size, func(fd int, tc *aio.TCPConn) {
+				tc.Bind(&conn{fd: fd, sender: tc})
+			})
+		})
+		b.Run(fmt.Sprintf("loop/%dB", size), func(b *testing.B) {
+			benchmarkEcho(b, size, func(fd int, tc *aio.TCPConn) {
+				tc.Bind(&benchConn{tc: tc, rsp: make([]byte, size)})
+			})
+		})
+	}
+}
+
+// benchConn replies with rsp when whole message is received. Client waits for
+// the reply before sending next message so rsp is reused.
+type benchConn struct {
+	tc  *aio.TCPConn
+	rsp []byte
+	n   int
+}
+
+func (c *benchConn) Received(data []byte) {
+	c.n += len(data)
+	if c.n >= len(c.rsp) {
+		c.n -= len(c.rsp)
+		c.tc.Send(c.rsp)
+	}
+}
+func (c *benchConn) Sent()        {}
+func (c *benchConn) Closed(error) {}
+
+func benchmarkEcho(b *testing.B, size int, accepted func(fd int, tc *aio.TCPConn)) {
+	loop, err := aio.New(aio.Options{
+		RingEntries:      128,
+		RecvBuffersCount: 256,
+		RecvBufferLen:    1024,
+	})
+	require.NoError(b, err)
+	defer loop.Close()
+	ln, err := loop.Listen("127.0.0.1:0", accepted)
+	require.NoError(b, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan error)
+	go func() { runDone <- loop.Run(ctx) }()
+
+	cli, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", ln.Port()), time.Second)
+	require.NoError(b, err)
+	msg := make([]byte, size)
+	rsp := make([]byte, size)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cli.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(cli, rsp); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	require.NoError(b, cli.Close())
+	cancel()
+	require.NoError(b, <-runDone)
+}
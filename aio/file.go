@@ -0,0 +1,265 @@
+package aio
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// OpenFile opens file at path. Flags and perm are as in os.OpenFile,
+// O_CLOEXEC is always added. Opened is called with file descriptor or error.
+func (l *Loop) OpenFile(path string, flag int, perm uint32, opened func(fd int, err error)) {
+	name, err := syscall.ByteSliceFromString(path)
+	if err != nil {
+		opened(-1, &os.PathError{Op: "open", Path: path, Err: err})
+		return
+	}
+	var pinner runtime.Pinner
+	pinner.Pin(&name[0])
+	l.prepareOpenat(name, flag|syscall.O_CLOEXEC, perm, func(res int32, flags uint32, err *ErrErrno) {
+		pinner.Unpin()
+		if err != nil {
+			opened(-1, &os.PathError{Op: "open", Path: path, Err: err.Errno})
+			return
+		}
+		opened(int(res), nil)
+	})
+}
+
+// Read reads up to len(buf) bytes from fd at offset. Offset -1 reads from
+// the current file position. Buf must not be modified until read is called.
+// On end of file read is called with io.EOF.
+func (l *Loop) Read(fd int, buf []byte, offset int64, read func(n int, err error)) {
+	if len(buf) == 0 {
+		read(0, nil)
+		return
+	}
+	var pinner runtime.Pinner
+	pinner.Pin(&buf[0])
+	l.prepareRead(fd, buf, uint64(offset), func(res int32, flags uint32, err *ErrErrno) {
+		pinner.Unpin()
+		if err != nil {
+			read(0, err)
+			return
+		}
+		if res == 0 {
+			read(0, io.EOF)
+			return
+		}
+		read(int(res), nil)
+	})
+}
+
+// CloseFile closes file descriptor opened by OpenFile.
+func (l *Loop) CloseFile(fd int, closed func(err error)) {
+	l.prepareClose(fd, func(res int32, flags uint32, err *ErrErrno) {
+		if closed == nil {
+			return
+		}
+		if err != nil {
+			closed(err)
+			return
+		}
+		closed(nil)
+	})
+}
+
+// #region SendFile
+
+// pipeChunk is the maximum number of bytes moved by single splice, default
+// pipe capacity
+const pipeChunk = 64 * 1024
+
+// fileSend is outbound queue entry which sends file content
+type fileSend struct {
+	path   string // file to open when fd is not set
+	fd     int
+	offset int64
+	owned  bool // fd is opened by the connection and closed when done
+}
+
+// SendFile sends length bytes of the file fd starting at offset. If length is
+// not positive file is sent to the end. File content is moved to the socket
+// by splice through the pipe, without copying it to the user space. Sent is
+// called when the file is written, or with error. Fd must stay open until
+// then. Send is ordered with other sends on the connection.
+func (tc *TCPConn) SendFile(fd int, offset, length int64, sent func(n int, err error)) {
+	if length <= 0 {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			tc.sent(sent, 0, err)
+			return
+		}
+		length = st.Size - offset
+		if length < 0 {
+			length = 0
+		}
+	}
+	tc.enqueueFile(&fileSend{fd: fd, offset: offset}, int(length), sent)
+}
+
+// SendFilePath is SendFile for the file at path. File is opened when it comes
+// to the head of the outbound queue and closed when sent. If the file can't
+// be opened sent is called with error and connection stays open.
+func (tc *TCPConn) SendFilePath(path string, offset, length int64, sent func(n int, err error)) {
+	if length < 0 {
+		length = 0
+	}
+	tc.enqueueFile(&fileSend{path: path, fd: -1, offset: offset, owned: true}, int(length), sent)
+}
+
+func (tc *TCPConn) enqueueFile(f *fileSend, length int, sent func(n int, err error)) {
+	if tc.shutdownError != nil {
+		tc.sent(sent, 0, tc.shutdownError)
+		return
+	}
+	if tc.writeClosed {
+		tc.sent(sent, 0, ErrWriteClosed)
+		return
+	}
+	e := &outEntry{file: f, len: length, sent: sent}
+	tc.pushOut(e)
+	tc.queued += e.len
+	tc.checkHighWaterMark()
+	tc.flush()
+}
+
+// flushFile writes file entry from the head of the outbound queue. File
+// content is spliced to the pipe and from the pipe to the socket, chunk by
+// chunk.
+func (tc *TCPConn) flushFile(e *outEntry) {
+	f := e.file
+	if f.fd < 0 {
+		tc.openFile(e)
+		return
+	}
+	if e.n == e.len {
+		// empty or fully sent
+		tc.written(0)
+		tc.flush()
+		return
+	}
+	if err := tc.openPipe(); err != nil {
+		tc.shutdown(err)
+		return
+	}
+	chunk := e.len - e.n
+	if chunk > pipeChunk {
+		chunk = pipeChunk
+	}
+	tc.writing = true
+	tc.loop.prepareSplice(f.fd, f.offset+int64(e.n), tc.pipe[1], -1, uint32(chunk), func(res int32, flags uint32, err *ErrErrno) {
+		if tc.shutdownError != nil {
+			tc.writing = false
+			return
+		}
+		if err != nil {
+			tc.writing = false
+			tc.fileFailed(err)
+			return
+		}
+		if res == 0 {
+			// file is shorter than expected
+			tc.writing = false
+			tc.fileFailed(io.ErrUnexpectedEOF)
+			return
+		}
+		tc.splicePipe(int(res))
+	})
+}
+
+// splicePipe moves n bytes from the pipe to the socket.
+func (tc *TCPConn) splicePipe(n int) {
+	tc.loop.prepareSplice(tc.pipe[0], -1, tc.fd, -1, uint32(n), func(res int32, flags uint32, err *ErrErrno) {
+		if tc.shutdownError != nil {
+			tc.writing = false
+			return
+		}
+		if err != nil {
+			tc.writing = false
+			tc.shutdown(err)
+			return
+		}
+		tc.written(int(res))
+		if int(res) < n {
+			tc.splicePipe(n - int(res))
+			return
+		}
+		tc.writing = false
+		tc.flush()
+	})
+}
+
+// openFile opens file of the SendFilePath entry.
+func (tc *TCPConn) openFile(e *outEntry) {
+	f := e.file
+	tc.writing = true
+	tc.loop.OpenFile(f.path, syscall.O_RDONLY, 0, func(fd int, err error) {
+		tc.writing = false
+		if tc.shutdownError != nil {
+			if err == nil {
+				tc.loop.CloseFile(fd, nil)
+			}
+			return
+		}
+		if err != nil {
+			tc.fileFailed(err)
+			return
+		}
+		f.fd = fd
+		if e.len == 0 {
+			var st syscall.Stat_t
+			if err := syscall.Fstat(fd, &st); err != nil {
+				tc.fileFailed(err)
+				return
+			}
+			if st.Size > f.offset {
+				e.len = int(st.Size - f.offset)
+				tc.queued += e.len
+				tc.checkHighWaterMark()
+			}
+		}
+		tc.flush()
+	})
+}
+
+// fileFailed removes file entry from the head of the queue when file can't
+// be read. If part of the file is already sent connection is closed, stream
+// is broken.
+func (tc *TCPConn) fileFailed(err error) {
+	e := tc.outq[0]
+	if e.n > 0 {
+		tc.shutdown(err)
+		return
+	}
+	tc.popOut()
+	tc.queued -= e.len
+	tc.release(e)
+	tc.sent(e.sent, 0, err)
+	tc.checkHighWaterMark()
+	tc.flush()
+}
+
+// openPipe creates pipe used for splice
+func (tc *TCPConn) openPipe() error {
+	if tc.pipe[0] > 0 {
+		return nil
+	}
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		return err
+	}
+	tc.pipe = p
+	return nil
+}
+
+func (tc *TCPConn) closePipe() {
+	if tc.pipe[0] > 0 {
+		_ = syscall.Close(tc.pipe[0])
+		_ = syscall.Close(tc.pipe[1])
+		tc.pipe = [2]int{}
+	}
+}
+
+// #endregion
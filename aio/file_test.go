@@ -0,0 +1,103 @@
+package aio
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoopFile(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	path := filepath.Join(t.TempDir(), "file")
+	data := testRandomBuf(t, 8*1024)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	var read []byte
+	var closeErr error = io.ErrUnexpectedEOF
+	loop.OpenFile(path, syscall.O_RDONLY, 0, func(fd int, err error) {
+		require.NoError(t, err)
+		buf := make([]byte, 1024)
+		var next func(n int, err error)
+		next = func(n int, err error) {
+			if err == io.EOF {
+				loop.CloseFile(fd, func(err error) { closeErr = err })
+				return
+			}
+			require.NoError(t, err)
+			read = append(read, buf[:n]...)
+			loop.Read(fd, buf, int64(len(read)), next)
+		}
+		loop.Read(fd, buf, 0, next)
+	})
+	var openErr error
+	loop.OpenFile(filepath.Join(t.TempDir(), "missing"), syscall.O_RDONLY, 0, func(fd int, err error) {
+		openErr = err
+	})
+	require.NoError(t, loop.runUntilDone())
+
+	require.Equal(t, data, read)
+	require.NoError(t, closeErr)
+	require.ErrorIs(t, openErr, os.ErrNotExist)
+}
+
+func TestTCPConnSendFile(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+	received := make(chan []byte)
+	go func() {
+		conn, err := listen.Accept()
+		require.NoError(t, err)
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		conn.Close()
+		received <- buf
+	}()
+
+	path := filepath.Join(t.TempDir(), "file")
+	data := testRandomBuf(t, 1024*1024)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	var sent []int
+	var missingErr error
+	require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		tc.Bind(&testConn{})
+		tc.Send([]byte("header"))
+		tc.SendFilePath(path, 0, 0, func(n int, err error) {
+			require.NoError(t, err)
+			sent = append(sent, n)
+		})
+		tc.SendFilePath(path+".missing", 0, 0, func(n int, err error) { missingErr = err })
+		tc.Send([]byte("middle"))
+		tc.SendFile(int(f.Fd()), 100, 1000, func(n int, err error) {
+			require.NoError(t, err)
+			sent = append(sent, n)
+			tc.Close()
+		})
+		require.Equal(t, 6+6+1000, tc.Queued())
+	}))
+	require.NoError(t, loop.runUntilDone())
+
+	expected := append([]byte("header"), data...)
+	expected = append(expected, []byte("middle")...)
+	expected = append(expected, data[100:1100]...)
+	require.Equal(t, expected, <-received)
+	require.Equal(t, []int{len(data), 1000}, sent)
+	require.ErrorIs(t, missingErr, os.ErrNotExist)
+}
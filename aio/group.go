@@ -0,0 +1,153 @@
+package aio
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Group is set of loops (shards). Each loop has its own ring and provided
+// buffers and runs in its own goroutine locked to the OS thread.
+// Listen on the group listens on the same address in every shard, kernel
+// distributes accepted connections between shards (SO_REUSEPORT).
+type Group struct {
+	loops []*Loop
+}
+
+// NewGroup creates group of shards loops. If shards is not positive number of
+// CPUs is used.
+func NewGroup(shards int, opt Options) (*Group, error) {
+	if shards <= 0 {
+		shards = runtime.NumCPU()
+	}
+	g := &Group{}
+	for i := 0; i < shards; i++ {
+		loop, err := New(opt)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.loops = append(g.loops, loop)
+	}
+	return g, nil
+}
+
+// Loops returns group shards.
+func (g *Group) Loops() []*Loop {
+	return g.loops
+}
+
+// Listen starts listener on the same address in each shard. Accepted callback
+// is called in the goroutine of the shard which accepted connection.
+// Must be called before Run.
+func (g *Group) Listen(addr string, accepted Accepted) ([]*TCPListener, error) {
+	return g.ListenWith(addr, DefaultListenConfig, accepted)
+}
+
+// ListenWith is Listen with listening socket options. Cfg must have ReusePort
+// set when group has more than one shard.
+func (g *Group) ListenWith(addr string, cfg ListenConfig, accepted Accepted) ([]*TCPListener, error) {
+	var listeners []*TCPListener
+	for _, loop := range g.loops {
+		ln, err := loop.ListenWith(addr, cfg, accepted)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+		if len(listeners) == 1 {
+			// in the case of system assigned port use first listener's port
+			// for all others
+			host, port, err := net.SplitHostPort(addr)
+			if err == nil && port == "0" {
+				addr = net.JoinHostPort(host, strconv.Itoa(ln.Port()))
+			}
+		}
+	}
+	return listeners, nil
+}
+
+// Run runs each shard until ctx is cancelled. Returns when all shards are
+// finished.
+func (g *Group) Run(ctx context.Context) error {
+	cpus := allowedCPUs()
+	errs := make([]error, len(g.loops))
+	var wg sync.WaitGroup
+	for i, loop := range g.loops {
+		wg.Add(1)
+		go func(i int, loop *Loop) {
+			defer wg.Done()
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			if len(cpus) > 0 && len(g.loops) <= len(cpus) {
+				// pin shard to the cpu, best effort
+				var set unix.CPUSet
+				set.Set(cpus[i])
+				_ = unix.SchedSetaffinity(0, &set)
+			}
+			errs[i] = loop.Run(ctx)
+		}(i, loop)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Shutdown gracefully shuts down all shards, see Loop.Shutdown. Returns sum
+// of the shards reports.
+func (g *Group) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	reports := make([]ShutdownReport, len(g.loops))
+	errs := make([]error, len(g.loops))
+	var wg sync.WaitGroup
+	for i, loop := range g.loops {
+		wg.Add(1)
+		go func(i int, loop *Loop) {
+			defer wg.Done()
+			reports[i], errs[i] = loop.Shutdown(ctx)
+		}(i, loop)
+	}
+	wg.Wait()
+	var report ShutdownReport
+	for _, r := range reports {
+		report.Clean += r.Clean
+		report.Forced += r.Forced
+	}
+	return report, errors.Join(errs...)
+}
+
+// Close closes all shards loops.
+func (g *Group) Close() {
+	for _, loop := range g.loops {
+		loop.Close()
+	}
+}
+
+// Stats returns stats for each shard.
+func (g *Group) Stats() []Stats {
+	stats := make([]Stats, len(g.loops))
+	for i, loop := range g.loops {
+		stats[i] = loop.Stats()
+	}
+	return stats
+}
+
+// allowedCPUs returns list of cpus on which the process is allowed to run.
+func allowedCPUs() []int {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil
+	}
+	var cpus []int
+	for i := 0; len(cpus) < set.Count(); i++ {
+		if set.IsSet(i) {
+			cpus = append(cpus, i)
+		}
+	}
+	return cpus
+}
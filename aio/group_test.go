@@ -0,0 +1,81 @@
+package aio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupListen(t *testing.T) {
+	group, err := NewGroup(2, Options{
+		RingEntries:      16,
+		RecvBuffersCount: 8,
+		RecvBufferLen:    1024,
+	})
+	require.NoError(t, err)
+	defer group.Close()
+
+	listeners, err := group.Listen("127.0.0.1:0", func(fd int, tc *TCPConn) {
+		tc.Bind(&testEchoConn{tc: tc})
+	})
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+	port := listeners[0].Port()
+	require.Equal(t, port, listeners[1].Port())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan error)
+	go func() {
+		runDone <- group.Run(ctx)
+	}()
+
+	data := testRandomBuf(t, 1024)
+	for i := 0; i < 16; i++ {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+		require.NoError(t, err)
+		_, err = conn.Write(data)
+		require.NoError(t, err)
+		rsp := make([]byte, len(data))
+		_, err = io.ReadFull(conn, rsp)
+		require.NoError(t, err)
+		require.Equal(t, data, rsp)
+		require.NoError(t, conn.Close())
+	}
+
+	stats := group.Stats()
+	require.Len(t, stats, 2)
+	require.Equal(t, int64(1), stats[0].Listeners)
+	require.Equal(t, int64(1), stats[1].Listeners)
+
+	cancel()
+	require.NoError(t, <-runDone)
+	var total Stats
+	for _, s := range group.Stats() {
+		require.Equal(t, int64(0), s.Connections)
+		require.Equal(t, int64(0), s.Listeners)
+		require.Equal(t, int64(0), s.InFlight)
+		require.Equal(t, int64(0), s.Pending)
+		total.Accepted += s.Accepted
+		total.Closed += s.Closed
+		total.BytesReceived += s.BytesReceived
+		total.BytesSent += s.BytesSent
+	}
+	require.Equal(t, uint64(16), total.Accepted)
+	require.Equal(t, uint64(16), total.Closed)
+	require.Equal(t, uint64(16*len(data)), total.BytesReceived)
+	require.Equal(t, uint64(16*len(data)), total.BytesSent)
+}
+
+// testEchoConn sends back everything received
+type testEchoConn struct {
+	tc *TCPConn
+}
+
+func (c *testEchoConn) Received(buf []byte) { c.tc.Send(toOwn(buf)) }
+func (c *testEchoConn) Sent()               {}
+func (c *testEchoConn) Closed(error)        {}
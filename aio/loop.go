@@ -2,39 +2,85 @@ package aio
 
 import (
 	"context"
+	"errors"
 	"log/slog"
-	"math"
 	"os"
-	"runtime"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
 
 	"github.com/pawelgaczynski/giouring"
+	"golang.org/x/sys/unix"
 )
 
 const (
-	batchSize      = 128
-	buffersGroupID = 0 // currently using only 1 provided buffer group
+	batchSize = 128
 )
 
 type completionCallback = func(res int32, flags uint32, err *ErrErrno)
 type operation = func(*giouring.SubmissionQueueEntry)
 
 type Loop struct {
-	ring      *giouring.Ring
+	ring      ring
+	backend   Backend
+	features  features
+	disabled  bool // ring is enabled on first run, see enableRing
+	issuerTid int  // thread locked by enableRing
 	callbacks callbacks
-	buffers   providedBuffers
+	cqes      [batchSize]*giouring.CompletionQueueEvent
+	buffers   []*providedBuffers // provided buffer groups, index is group id
 	pending   []operation
+	posted    posted
+	stats     loopStats
 
 	listeners   map[int]*TCPListener
 	connections map[int]*TCPConn
+	udpConns    map[int]*UDPConn
+	timers      map[*Timer]struct{}
+	dials       map[*dial]struct{} // in progress
+	shutdown    *shutdownState
+	runExit     chan struct{} // closed when Run returns
+	runExitOnce sync.Once
 }
 
 type Options struct {
 	RingEntries      uint32
 	RecvBuffersCount uint32
 	RecvBufferLen    uint32
+	// RecvBuffersMaxCount enables automatic growth of the default buffer
+	// group, see BufferGroup.
+	RecvBuffersMaxCount uint32
+	// BufferGroups are additional provided buffer groups. Group id is index
+	// in this slice plus one, group 0 is the default group.
+	BufferGroups []BufferGroup
+	// Backend selects io_uring or epoll implementation, default is io_uring
+	// with fallback to epoll.
+	Backend Backend
+
+	// io_uring setup options, ignored by the epoll backend
+
+	// SQPoll starts kernel thread which polls submission queue, loop submits
+	// without syscalls. Thread goes to sleep after SQPollIdle without
+	// submissions, zero means kernel default of one second.
+	SQPoll     bool
+	SQPollIdle time.Duration
+	// CoopTaskrun stops kernel from interrupting the loop thread to run
+	// completion work, it is run when the loop enters the kernel.
+	CoopTaskrun bool
+	// SingleIssuer tells kernel that only one thread submits. Loop goroutine
+	// is locked to the OS thread on which it starts running and loop owns
+	// the thread until Close. Loop must be run and closed from that
+	// goroutine.
+	SingleIssuer bool
+	// DeferTaskrun runs completion work only when the loop waits for
+	// completions. Implies SingleIssuer.
+	DeferTaskrun bool
+	// FixedFiles is size of the registered files table, zero disables it.
+	// Connections are registered in the table and send, recv, shutdown and
+	// close use table index, which saves kernel file lookup on each
+	// operation. When the table is full connection uses regular fd.
+	FixedFiles uint32
 }
 
 var DefaultOptions = Options{
@@ -44,19 +90,36 @@ var DefaultOptions = Options{
 }
 
 func New(opt Options) (*Loop, error) {
-	ring, err := giouring.CreateRing(opt.RingEntries)
-	if err != nil {
-		return nil, err
-	}
 	l := &Loop{
-		ring:        ring,
 		listeners:   make(map[int]*TCPListener),
 		connections: make(map[int]*TCPConn),
+		udpConns:    make(map[int]*UDPConn),
+		timers:      make(map[*Timer]struct{}),
+		dials:       make(map[*dial]struct{}),
+		runExit:     make(chan struct{}),
+	}
+	if err := l.initRing(opt); err != nil {
+		return nil, err
 	}
 	l.callbacks.init()
-	if err := l.buffers.init(ring, opt.RecvBuffersCount, opt.RecvBufferLen); err != nil {
+	if err := l.initBuffers(opt); err != nil {
+		l.ring.QueueExit()
+		l.deinitBuffers()
+		var errno syscall.Errno
+		if opt.Backend == BackendAuto && l.backend == BackendIOUring && errors.As(err, &errno) {
+			// kernel without buffer rings
+			slog.Info("io_uring buffer rings not available, using epoll", "err", err)
+			opt.Backend = BackendEpoll
+			return New(opt)
+		}
 		return nil, err
 	}
+	if err := l.posted.init(); err != nil {
+		l.ring.QueueExit()
+		l.deinitBuffers()
+		return nil, err
+	}
+	l.preparePostedRead()
 	return l, nil
 }
 
@@ -64,6 +127,9 @@ func New(opt Options) (*Loop, error) {
 // Submits all prepared operations to the kernel and waits for at least one
 // completed operation by the kernel.
 func (l *Loop) runOnce() error {
+	if err := l.enableRing(); err != nil {
+		return err
+	}
 	if err := l.submitAndWait(1); err != nil {
 		return err
 	}
@@ -74,9 +140,9 @@ func (l *Loop) runOnce() error {
 // runUntilDone runs loop until all prepared operations are finished.
 func (l *Loop) runUntilDone() error {
 	for {
-		if l.callbacks.count() == 0 {
+		if l.callbacks.count() == 0 && len(l.dials) == 0 {
 			if len(l.connections) > 0 || len(l.listeners) > 0 {
-				panic("unclean shutdown")
+				l.closeRemaining()
 			}
 			return nil
 		}
@@ -86,30 +152,51 @@ func (l *Loop) runUntilDone() error {
 	}
 }
 
-// Run runs loop until ctx is cancelled. Then performs clean shutdown.
-// After ctx is done it closes all pending listeners and dialed connections.
-// Listener will first stop listening then close all accepted connections.
+// Run runs loop until ctx is cancelled or Shutdown is called. Then performs
+// clean shutdown.
+// After ctx is done it stops all timers, listeners and closes all
+// connections. Connections with pending sends are closed without waiting for
+// sends to finish, use Shutdown for graceful shutdown.
 // Loop will wait for all operations to finish.
 func (l *Loop) Run(ctx context.Context) error {
+	defer l.runExitOnce.Do(func() {
+		l.posted.stop()
+		close(l.runExit)
+	})
+	// wake up loop as soon as ctx is done
+	stop := context.AfterFunc(ctx, func() { l.Post(func() {}) })
+	defer stop()
 	// run until ctx is done
 	if err := l.runCtx(ctx, time.Millisecond*333); err != nil {
 		return err
 	}
-	l.closePendingConnections()
+	if l.shutdown == nil {
+		l.closePendingConnections()
+	}
 	// run loop until all operations finishes
 	if err := l.runUntilDone(); err != nil {
 		return err
 	}
+	l.finishShutdown()
 	return nil
 }
 
+// closePendingConnections stops timers and dials, closes all listeners and
+// connections.
 func (l *Loop) closePendingConnections() {
+	l.stopTimers()
+	for d := range l.dials {
+		d.cancel(ErrLoopShutdown)
+	}
 	for _, lsn := range l.listeners {
 		lsn.Close()
 	}
 	for _, conn := range l.connections {
 		conn.Close()
 	}
+	for _, conn := range l.udpConns {
+		conn.Close()
+	}
 }
 
 // runCtx runs loop until context is canceled.
@@ -124,6 +211,9 @@ func (l *Loop) runCtx(ctx context.Context, timeout time.Duration) error {
 		}
 		return false
 	}
+	if err := l.enableRing(); err != nil {
+		return err
+	}
 	for {
 		if err := l.submit(); err != nil {
 			return err
@@ -132,7 +222,7 @@ func (l *Loop) runCtx(ctx context.Context, timeout time.Duration) error {
 			return err
 		}
 		_ = l.flushCompletions()
-		if done() {
+		if done() || l.shutdown != nil {
 			break
 		}
 	}
@@ -182,6 +272,7 @@ func (l *Loop) preparePending() {
 		op(sqe)
 		prepared++
 	}
+	l.stats.submitted.Add(uint64(prepared))
 	if prepared == len(l.pending) {
 		l.pending = nil
 	} else {
@@ -194,22 +285,31 @@ func (l *Loop) submit() error {
 }
 
 func (l *Loop) flushCompletions() uint32 {
-	var cqes [batchSize]*giouring.CompletionQueueEvent
 	var noCompleted uint32 = 0
 	for {
-		peeked := l.ring.PeekBatchCQE(cqes[:])
-		for _, cqe := range cqes[:peeked] {
+		peeked := l.ring.PeekBatchCQE(l.cqes[:])
+		for _, cqe := range l.cqes[:peeked] {
 			err := cqeErr(cqe)
 			if cqe.UserData == 0 {
 				slog.Debug("ceq without userdata", "res", cqe.Res, "flags", cqe.Flags, "err", err)
 				continue
 			}
+			if cqe.UserData == postUserData {
+				l.runPosted(err)
+				continue
+			}
 			cb := l.callbacks.get(cqe)
+			if cb == nil {
+				slog.Debug("cqe without callback", "userData", cqe.UserData, "res", cqe.Res, "flags", cqe.Flags)
+				continue
+			}
 			cb(cqe.Res, cqe.Flags, err)
 		}
 		l.ring.CQAdvance(peeked)
 		noCompleted += peeked
-		if peeked < uint32(len(cqes)) {
+		if peeked < uint32(len(l.cqes)) {
+			l.stats.completed.Add(uint64(noCompleted))
+			l.updateGauges()
 			return noCompleted
 		}
 	}
@@ -217,7 +317,9 @@ func (l *Loop) flushCompletions() uint32 {
 
 func (l *Loop) Close() {
 	l.ring.QueueExit()
-	l.buffers.deinit()
+	l.deinitBuffers()
+	l.posted.deinit()
+	l.releaseThread()
 }
 
 // prepares operation or adds it to pending if can't get sqe
@@ -229,9 +331,11 @@ func (l *Loop) prepare(op operation) {
 	}
 	if sqe == nil { // still nothing, add to pending
 		l.pending = append(l.pending, op)
+		l.stats.pending.Store(int64(len(l.pending)))
 		return
 	}
 	op(sqe)
+	l.stats.submitted.Add(1)
 }
 
 func (l *Loop) prepareMultishotAccept(fd int, cb completionCallback) {
@@ -241,6 +345,13 @@ func (l *Loop) prepareMultishotAccept(fd int, cb completionCallback) {
 	})
 }
 
+func (l *Loop) prepareCancel(userData uint64, cb completionCallback) {
+	l.prepare(func(sqe *giouring.SubmissionQueueEntry) {
+		sqe.PrepareCancel64(userData, 0)
+		l.callbacks.set(sqe, cb)
+	})
+}
+
 func (l *Loop) prepareCancelFd(fd int, cb completionCallback) {
 	l.prepare(func(sqe *giouring.SubmissionQueueEntry) {
 		sqe.PrepareCancelFd(fd, 0)
@@ -248,10 +359,12 @@ func (l *Loop) prepareCancelFd(fd int, cb completionCallback) {
 	})
 }
 
-func (l *Loop) prepareShutdown(fd int, cb completionCallback) {
+// how is one of syscall.SHUT_RD, SHUT_WR, SHUT_RDWR
+// fixed is registered file index of the fd, -1 if not registered
+func (l *Loop) prepareShutdown(fd, fixed int, how int, cb completionCallback) {
 	l.prepare(func(sqe *giouring.SubmissionQueueEntry) {
-		const SHUT_RDWR = 2
-		sqe.PrepareShutdown(fd, SHUT_RDWR)
+		sqe.PrepareShutdown(fd, how)
+		useFixed(sqe, fixed)
 		l.callbacks.set(sqe, cb)
 	})
 }
@@ -263,31 +376,82 @@ func (l *Loop) prepareClose(fd int, cb completionCallback) {
 	})
 }
 
-// assumes that buf is already pinned in the caller
-func (l *Loop) prepareSend(fd int, buf []byte, cb completionCallback) {
+// prepareCloseFixed removes file from the registered files table
+func (l *Loop) prepareCloseFixed(fixed int, cb completionCallback) {
 	l.prepare(func(sqe *giouring.SubmissionQueueEntry) {
-		sqe.PrepareSend(fd, uintptr(unsafe.Pointer(&buf[0])), uint32(len(buf)), 0)
+		sqe.PrepareCloseDirect(uint32(fixed))
 		l.callbacks.set(sqe, cb)
 	})
 }
 
-// references from std lib:
-// https://github.com/golang/go/blob/140266fe7521bf75bf0037f12265190213cc8e7d/src/internal/poll/writev.go#L16
-// https://github.com/golang/go/blob/140266fe7521bf75bf0037f12265190213cc8e7d/src/internal/poll/fd_writev_unix.go#L20
-// assumes that iovecs are pinner in caller
-func (l *Loop) prepareWritev(fd int, iovecs []syscall.Iovec, cb completionCallback) {
+// prepareRegisterFile registers fd in the first free slot of the registered
+// files table. On success slot index is written to fd.
+// assumes that fd is pinned in the caller
+func (l *Loop) prepareRegisterFile(fd *int32, cb completionCallback) {
 	l.prepare(func(sqe *giouring.SubmissionQueueEntry) {
-		sqe.PrepareWritev(fd, uintptr(unsafe.Pointer(&iovecs[0])), uint32(len(iovecs)), 0)
+		sqe.PrepareFilesUpdate(nil, int(giouring.FileIndexAlloc))
+		// giouring passes address of the slice header and uses int slice,
+		// kernel expects int32 array, fix it here
+		sqe.Addr = uint64(uintptr(unsafe.Pointer(fd)))
+		sqe.Len = 1
 		l.callbacks.set(sqe, cb)
 	})
 }
 
-// Multishot, provided buffers recv
-func (l *Loop) prepareRecv(fd int, cb completionCallback) {
+// useFixed makes sqe reference registered file instead of the fd
+func useFixed(sqe *giouring.SubmissionQueueEntry, fixed int) {
+	if fixed < 0 {
+		return
+	}
+	sqe.Fd = int32(fixed)
+	sqe.Flags |= giouring.SqeFixedFile
+}
+
+// Multishot, provided buffers recvmsg
+// assumes that msg is pinned in the caller
+func (l *Loop) prepareRecvMsg(fd int, msg *syscall.Msghdr, group uint16, cb completionCallback) {
 	l.prepare(func(sqe *giouring.SubmissionQueueEntry) {
-		sqe.PrepareRecvMultishot(fd, 0, 0, 0)
+		if l.features.multishotRecv {
+			sqe.PrepareRecvMsgMultishot(fd, msg, 0)
+		} else {
+			sqe.PrepareRecvMsg(fd, msg, 0)
+		}
 		sqe.Flags = giouring.SqeBufferSelect
-		sqe.BufIG = buffersGroupID
+		sqe.BufIG = group
+		l.callbacks.set(sqe, cb)
+	})
+}
+
+// assumes that msg and all buffers it references are pinned in the caller
+func (l *Loop) prepareSendMsg(fd int, msg *syscall.Msghdr, cb completionCallback) {
+	l.prepare(func(sqe *giouring.SubmissionQueueEntry) {
+		sqe.PrepareSendMsg(fd, msg, 0)
+		l.callbacks.set(sqe, cb)
+	})
+}
+
+// path must be nul terminated and pinned in the caller
+func (l *Loop) prepareOpenat(path []byte, flags int, mode uint32, cb completionCallback) {
+	l.prepare(func(sqe *giouring.SubmissionQueueEntry) {
+		sqe.PrepareOpenat(unix.AT_FDCWD, path, flags, mode)
+		// giouring passes address of the slice header, fix it here
+		sqe.Addr = uint64(uintptr(unsafe.Pointer(&path[0])))
+		l.callbacks.set(sqe, cb)
+	})
+}
+
+// assumes that buf is already pinned in the caller
+func (l *Loop) prepareRead(fd int, buf []byte, offset uint64, cb completionCallback) {
+	l.prepare(func(sqe *giouring.SubmissionQueueEntry) {
+		sqe.PrepareRead(fd, uintptr(unsafe.Pointer(&buf[0])), uint32(len(buf)), offset)
+		l.callbacks.set(sqe, cb)
+	})
+}
+
+// offset -1 is used for pipes
+func (l *Loop) prepareSplice(fdIn int, offIn int64, fdOut int, offOut int64, n uint32, cb completionCallback) {
+	l.prepare(func(sqe *giouring.SubmissionQueueEntry) {
+		sqe.PrepareSplice(fdIn, offIn, fdOut, offOut, n, 0)
 		l.callbacks.set(sqe, cb)
 	})
 }
@@ -342,104 +506,70 @@ func (e *ErrErrno) ConnectionReset() bool {
 	return e.Errno == syscall.ECONNRESET || e.Errno == syscall.ENOTCONN
 }
 
-// #region providedBuffers
-
-type providedBuffers struct {
-	br      *giouring.BufAndRing
-	data    []byte
-	entries uint32
-	bufLen  uint32
-}
-
-func (b *providedBuffers) init(ring *giouring.Ring, entries uint32, bufLen uint32) error {
-	b.entries = entries
-	b.bufLen = bufLen
-	// mmap allocated space for all buffers
-	var err error
-	size := int(b.entries * b.bufLen)
-	b.data, err = syscall.Mmap(-1, 0, size,
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
-	if err != nil {
-		return err
-	}
-	// share buffers with io_uring
-	b.br, err = ring.SetupBufRing(b.entries, buffersGroupID, 0)
-	if err != nil {
-		return err
-	}
-	for i := uint32(0); i < b.entries; i++ {
-		b.br.BufRingAdd(
-			uintptr(unsafe.Pointer(&b.data[b.bufLen*i])),
-			b.bufLen,
-			uint16(i),
-			giouring.BufRingMask(b.entries),
-			int(i),
-		)
-	}
-	b.br.BufRingAdvance(int(b.entries))
-	return nil
-}
-
-// get provided buffer from cqe res, flags
-func (b *providedBuffers) get(res int32, flags uint32) ([]byte, uint16) {
-	isProvidedBuffer := flags&giouring.CQEFBuffer > 0
-	if !isProvidedBuffer {
-		panic("missing buffer flag")
-	}
-	bufferID := uint16(flags >> giouring.CQEBufferShift)
-	start := uint32(bufferID) * b.bufLen
-	n := uint32(res)
-	return b.data[start : start+n], bufferID
-}
-
-// return provided buffer to the kernel
-func (b *providedBuffers) release(buf []byte, bufferID uint16) {
-	b.br.BufRingAdd(
-		uintptr(unsafe.Pointer(&buf[0])),
-		b.bufLen,
-		uint16(bufferID),
-		giouring.BufRingMask(b.entries),
-		0,
-	)
-	b.br.BufRingAdvance(1)
-}
-
-func (b *providedBuffers) deinit() {
-	_ = syscall.Munmap(b.data)
-}
-
-//#endregion providedBuffers
-
 // #region callbacks
 
+// callbacks is registry of completion callbacks for operations in the kernel.
+// Callback is stored in the slot, slot index and generation are encoded in
+// the sqe user data. Generation is changed when slot is freed, so user data of
+// the completed operation (in cancel for example) never matches operation
+// which is reusing the slot.
 type callbacks struct {
-	m    map[uint64]completionCallback
-	next uint64
+	slots []callbackSlot
+	free  []uint32 // indexes of the free slots
+	used  int
+}
+
+type callbackSlot struct {
+	cb  completionCallback
+	gen uint32
 }
 
 func (c *callbacks) init() {
-	c.m = make(map[uint64]completionCallback)
-	c.next = math.MaxUint16 // reserve first few userdata values for internal use
+	c.slots = make([]callbackSlot, 0, batchSize)
+	c.free = make([]uint32, 0, batchSize)
 }
 
 func (c *callbacks) set(sqe *giouring.SubmissionQueueEntry, cb completionCallback) {
-	c.next++
-	key := c.next
-	c.m[key] = cb
-	sqe.UserData = key
+	var idx uint32
+	if n := len(c.free); n > 0 {
+		idx = c.free[n-1]
+		c.free = c.free[:n-1]
+	} else {
+		// generation starts from 1, that keeps user data above values
+		// reserved for internal use
+		idx = uint32(len(c.slots))
+		c.slots = append(c.slots, callbackSlot{gen: 1})
+	}
+	s := &c.slots[idx]
+	s.cb = cb
+	c.used++
+	sqe.UserData = uint64(s.gen)<<32 | uint64(idx)
 }
 
+// get returns callback for the completion, nil if there is no operation with
+// that user data. Slot is freed unless this is multishot completion with more
+// to come.
 func (c *callbacks) get(cqe *giouring.CompletionQueueEvent) completionCallback {
-	ms := isMultiShot(cqe.Flags)
-	cb := c.m[cqe.UserData]
-	if !ms {
-		delete(c.m, cqe.UserData)
+	idx, gen := uint32(cqe.UserData), uint32(cqe.UserData>>32)
+	if int(idx) >= len(c.slots) || c.slots[idx].gen != gen {
+		return nil
+	}
+	s := &c.slots[idx]
+	cb := s.cb
+	if !isMultiShot(cqe.Flags) {
+		s.cb = nil
+		s.gen++
+		if s.gen == 0 {
+			s.gen = 1
+		}
+		c.free = append(c.free, idx)
+		c.used--
 	}
 	return cb
 }
 
 func (c *callbacks) count() int {
-	return len(c.m)
+	return c.used
 }
 
 // #endregion
@@ -448,63 +578,42 @@ func isMultiShot(flags uint32) bool {
 	return flags&giouring.CQEFMore > 0
 }
 
-// callback fired when tcp connection is dialed
-type Dialed func(fd int, tcpConn *TCPConn, err error)
-
-func (l *Loop) Dial(addr string, dialed Dialed) error {
-	sa, domain, err := resolveTCPAddr(addr)
-	if err != nil {
-		return err
-	}
-	rawAddr, rawAddrLen, err := sockaddr(sa)
-	if err != nil {
-		return err
-	}
-	var pinner runtime.Pinner
-	pinner.Pin(rawAddr)
-	l.prepareStreamSocket(domain, func(res int32, flags uint32, err *ErrErrno) {
-		if err != nil {
-			dialed(0, nil, err)
-			pinner.Unpin()
-			return
-		}
-		fd := int(res)
-		l.prepareConnect(fd, uintptr(rawAddr), uint64(rawAddrLen), func(res int32, flags uint32, err *ErrErrno) {
-			defer pinner.Unpin()
-			if err != nil {
-				dialed(0, nil, err)
-				return
-			}
-			conn := newTcpConn(l, func() { delete(l.connections, fd) }, fd)
-			l.connections[fd] = conn
-			dialed(fd, conn, nil)
-		})
-	})
-	return nil
-}
-
 // callback fired when new connection is accepted by listener
 type Accepted func(fd int, tcpConn *TCPConn)
 
 // ip4:  "127.0.0.1:8080",
 // ip6: "[::1]:80"
+// unix domain socket: "unix:/run/app.sock"
+// abstract unix domain socket: "unix:@app"
+// Stale unix domain socket file is removed before listen, and on listener
+// close.
 func (l *Loop) Listen(addr string, accepted Accepted) (*TCPListener, error) {
-	sa, domain, err := resolveTCPAddr(addr)
+	return l.ListenWith(addr, DefaultListenConfig, accepted)
+}
+
+// ListenWith is Listen with listening socket options. Cfg Socket options are
+// set on each accepted connection.
+func (l *Loop) ListenWith(addr string, cfg ListenConfig, accepted Accepted) (*TCPListener, error) {
+	sa, domain, err := resolveAddr(addr)
 	if err != nil {
 		return nil, err
 	}
-	fd, port, err := listen(sa, domain)
+	fd, port, err := listen(sa, domain, cfg)
 	if err != nil {
 		return nil, err
 	}
 	ln := &TCPListener{
 		fd:          fd,
+		domain:      domain,
 		port:        port,
+		unixPath:    unixSocketPath(sa),
 		loop:        l,
 		accepted:    accepted,
+		socket:      cfg.Socket,
 		connections: make(map[int]*TCPConn),
 	}
 	l.listeners[fd] = ln
+	l.stats.listeners.Add(1)
 	ln.accept()
 	return ln, nil
 }
@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pawelgaczynski/giouring"
 	"github.com/stretchr/testify/require"
 )
 
@@ -197,3 +198,502 @@ func TestErrnoTemporary(t *testing.T) {
 	require.True(t, TemporaryError(syscall.ETIME))
 	require.True(t, TemporaryError(syscall.ENOBUFS))
 }
+
+func TestTCPConnSendFunc(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+
+	data := testRandomBuf(t, 4096)
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	type result struct {
+		id  int
+		n   int
+		err error
+	}
+	var results []result
+	require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		tc.Bind(&testConn{})
+		tc.SendFunc(data[:1024], func(n int, err error) {
+			results = append(results, result{1, n, err})
+		})
+		tc.SendBuffersFunc([][]byte{data[1024:2048], data[2048:]}, func(n int, err error) {
+			results = append(results, result{2, n, err})
+			tc.Close()
+		})
+	}))
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := listen.Accept()
+		require.NoError(t, err)
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		conn.Close()
+		received <- buf
+	}()
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, data, <-received)
+	require.Equal(t, []result{{1, 1024, nil}, {2, 3072, nil}}, results)
+}
+
+func TestTCPConnZeroCopy(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+	if !loop.features.sendZC {
+		t.Skip("zero copy send not supported")
+	}
+
+	data := testRandomBuf(t, 1024*1024)
+	type result struct {
+		id  int
+		n   int
+		err error
+	}
+	var results []result
+	var notified []int // length of the zero copy send buffer on notification
+	require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		tc.Bind(&testConn{})
+		require.NoError(t, tc.SetZeroCopy(64*1024))
+		writeCb := tc.writeCb
+		tc.writeCb = func(res int32, flags uint32, err *ErrErrno) {
+			if flags&giouring.CQEFNotif != 0 {
+				notified = append(notified, len(tc.writeBuffers[0]))
+			}
+			writeCb(res, flags, err)
+		}
+		// small, large and again small buffer, large one is sent with zero copy
+		tc.SendFunc(data[:1024], func(n int, err error) {
+			results = append(results, result{1, n, err})
+		})
+		tc.SendBuffersFunc([][]byte{data[1024 : 512*1024], data[512*1024 : len(data)-1024]}, func(n int, err error) {
+			results = append(results, result{2, n, err})
+		})
+		tc.SendFunc(data[len(data)-1024:], func(n int, err error) {
+			results = append(results, result{3, n, err})
+			tc.Close()
+		})
+	}))
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := listen.Accept()
+		require.NoError(t, err)
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		conn.Close()
+		received <- buf
+	}()
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, data, <-received)
+	require.Equal(t, []result{{1, 1024, nil}, {2, len(data) - 2048, nil}, {3, 1024, nil}}, results)
+	// large buffer is sent with zero copy
+	require.NotEmpty(t, notified)
+	require.Equal(t, 512*1024-1024, notified[0])
+}
+
+func TestTCPConnZeroCopyClose(t *testing.T) {
+	// peer does not read, zero copy send is in flight when connection is
+	// closed
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+	if !loop.features.sendZC {
+		t.Skip("zero copy send not supported")
+	}
+
+	data := testRandomBuf(t, 8*1024*1024)
+	notified, calls := false, 0
+	var conn *TCPConn
+	require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		conn = tc
+		tc.Bind(&testConn{})
+		require.NoError(t, tc.SetZeroCopy(64*1024))
+		writeCb := tc.writeCb
+		tc.writeCb = func(res int32, flags uint32, err *ErrErrno) {
+			if flags&giouring.CQEFNotif != 0 {
+				notified = true
+			}
+			writeCb(res, flags, err)
+		}
+		tc.SendFunc(data, func(n int, err error) {
+			calls++
+			// buffer can be reused only after kernel is done with it
+			require.True(t, notified)
+			require.Error(t, err)
+		})
+		loop.AfterFunc(10*time.Millisecond, tc.Close)
+	}))
+	go func() {
+		conn, err := listen.Accept()
+		require.NoError(t, err)
+		// kernel holds zero copy buffer while it is in the peer receive queue
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+	}()
+
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, 1, calls)
+	require.Equal(t, 0, conn.queued)
+	require.Nil(t, conn.writeZCHeld)
+}
+
+// testSendOnSentConn sends next message from each Sent
+type testSendOnSentConn struct {
+	tc    *TCPConn
+	next  int
+	count int
+}
+
+func (c *testSendOnSentConn) send() {
+	c.tc.Send([]byte{byte(c.next)})
+	c.next++
+}
+
+func (c *testSendOnSentConn) Received([]byte) {}
+func (c *testSendOnSentConn) Closed(error)    {}
+func (c *testSendOnSentConn) Sent() {
+	c.count--
+	if c.next < 20 {
+		c.send()
+	}
+	if c.count == 0 {
+		c.tc.Close()
+	}
+}
+
+func TestTCPConnSendFromSent(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		c := &testSendOnSentConn{tc: tc, count: 20}
+		tc.Bind(c)
+		// first is written alone, rest are written with single writev
+		for i := 0; i < 4; i++ {
+			c.send()
+		}
+	}))
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := listen.Accept()
+		require.NoError(t, err)
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		conn.Close()
+		received <- buf
+	}()
+	require.NoError(t, loop.runUntilDone())
+	expected := make([]byte, 20)
+	for i := range expected {
+		expected[i] = byte(i)
+	}
+	require.Equal(t, expected, <-received)
+}
+
+func TestTCPConnOutboundQueue(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	const chunks, chunkLen, highWaterMark = 64, 64 * 1024, 1024 * 1024
+	data := testRandomBuf(t, chunks*chunkLen)
+	var marks []bool
+	var completed []int
+	require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		tc.Bind(&testConn{})
+		tc.SetHighWaterMark(highWaterMark, func(above bool) {
+			marks = append(marks, above)
+		})
+		for i := 0; i < chunks; i++ {
+			i := i
+			chunk := data[i*chunkLen : (i+1)*chunkLen]
+			tc.SendFunc(chunk, func(n int, err error) {
+				require.NoError(t, err)
+				require.Equal(t, chunkLen, n)
+				completed = append(completed, i)
+				if i == chunks-1 {
+					require.Equal(t, 0, tc.Queued())
+					tc.Close()
+				}
+			})
+		}
+		require.Equal(t, len(data), tc.Queued())
+	}))
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := listen.Accept()
+		require.NoError(t, err)
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		conn.Close()
+		received <- buf
+	}()
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, data, <-received)
+	require.Len(t, completed, chunks)
+	for i, c := range completed {
+		require.Equal(t, i, c)
+	}
+	require.Equal(t, []bool{true, false}, marks)
+}
+
+func TestTCPConnCloseWrite(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+	// server reads request until EOF then sends response
+	go func() {
+		conn, err := listen.Accept()
+		require.NoError(t, err)
+		req, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		_, err = conn.Write(append([]byte("re: "), req...))
+		require.NoError(t, err)
+		conn.Close()
+	}()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	conn := &testCloseErrConn{}
+	var sendErr error
+	require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		tc.Bind(conn)
+		tc.Send([]byte("request"))
+		tc.CloseWrite()
+		tc.SendFunc([]byte("after close write"), func(n int, err error) { sendErr = err })
+	}))
+	require.NoError(t, loop.runUntilDone())
+
+	require.ErrorIs(t, sendErr, ErrWriteClosed)
+	require.Equal(t, "re: request", string(conn.received))
+	require.ErrorIs(t, conn.err, io.EOF)
+}
+
+type testCloseErrConn struct {
+	received []byte
+	err      error
+}
+
+func (c *testCloseErrConn) Received(buf []byte) { c.received = append(c.received, buf...) }
+func (c *testCloseErrConn) Sent()               {}
+func (c *testCloseErrConn) Closed(err error)    { c.err = err }
+
+func TestTCPConnPauseRecv(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	conn := &testPauseConn{t: t}
+	lsn, err := loop.Listen("127.0.0.1:0", func(fd int, tc *TCPConn) {
+		conn.tc = tc
+		tc.Bind(conn)
+	})
+	require.NoError(t, err)
+
+	data := testRandomBuf(t, 1024*1024)
+	go func() {
+		testSender(t, fmt.Sprintf("127.0.0.1:%d", lsn.Port()), data)
+	}()
+	for !conn.closed {
+		require.NoError(t, loop.runOnce())
+	}
+	require.Greater(t, conn.pauses, 1)
+	testRequireEqualBuffers(t, data, conn.received)
+
+	lsn.Close()
+	require.NoError(t, loop.runUntilDone())
+}
+
+func TestTCPConnPauseRecvPending(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	conn := &testCloseErrConn{}
+	var tc *TCPConn
+	lsn, err := loop.Listen("127.0.0.1:0", func(fd int, c *TCPConn) {
+		tc = c
+		tc.Bind(conn)
+	})
+	require.NoError(t, err)
+	client, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", lsn.Port()))
+	require.NoError(t, err)
+	for tc == nil {
+		require.NoError(t, loop.runOnce())
+	}
+	tc.PauseRecv()
+	for tc.recvArmed {
+		require.NoError(t, loop.runOnce())
+	}
+
+	// recv is armed but waits in the pending list, as when submission queue
+	// is full, and connection is paused before it is prepared
+	tc.recvPaused = false
+	tc.recvArmed = true
+	loop.pending = append(loop.pending, tc.recvOp)
+	tc.PauseRecv()
+
+	_, err = client.Write([]byte("foo"))
+	require.NoError(t, err)
+	done := false
+	loop.AfterFunc(20*time.Millisecond, func() { done = true })
+	for !done {
+		require.NoError(t, loop.runOnce())
+	}
+	require.False(t, tc.recvArmed)
+	require.Empty(t, tc.held)
+	require.Empty(t, conn.received)
+
+	tc.ResumeRecv()
+	for len(conn.received) < 3 {
+		require.NoError(t, loop.runOnce())
+	}
+	require.Equal(t, "foo", string(conn.received))
+
+	require.NoError(t, client.Close())
+	lsn.Close()
+	require.NoError(t, loop.runUntilDone())
+}
+
+// testPauseConn pauses receiving after each 64k and resumes after a while
+type testPauseConn struct {
+	t        *testing.T
+	tc       *TCPConn
+	received [][]byte
+	n        int
+	paused   bool
+	pauses   int
+	closed   bool
+}
+
+func (c *testPauseConn) Received(buf []byte) {
+	require.False(c.t, c.paused)
+	c.received = append(c.received, toOwn(buf))
+	c.n += len(buf)
+	if c.n >= 64*1024 {
+		c.n = 0
+		c.paused = true
+		c.pauses++
+		c.tc.PauseRecv()
+		c.tc.loop.AfterFunc(5*time.Millisecond, func() {
+			c.paused = false
+			c.tc.ResumeRecv()
+		})
+	}
+}
+func (c *testPauseConn) Sent()        {}
+func (c *testPauseConn) Closed(error) { c.closed = true }
+
+func TestCallbacks(t *testing.T) {
+	var c callbacks
+	c.init()
+	var sqe giouring.SubmissionQueueEntry
+	var fired []int
+	c.set(&sqe, func(res int32, flags uint32, err *ErrErrno) { fired = append(fired, 1) })
+	first := sqe.UserData
+	require.Greater(t, first, postUserData)
+	require.Equal(t, 1, c.count())
+
+	// multishot keeps slot
+	c.get(&giouring.CompletionQueueEvent{UserData: first, Flags: giouring.CQEFMore})(0, 0, nil)
+	require.Equal(t, 1, c.count())
+	c.get(&giouring.CompletionQueueEvent{UserData: first})(0, 0, nil)
+	require.Equal(t, 0, c.count())
+	require.Equal(t, []int{1, 1}, fired)
+
+	// slot is reused with new generation, stale user data is not found
+	c.set(&sqe, func(res int32, flags uint32, err *ErrErrno) { fired = append(fired, 2) })
+	require.Equal(t, uint32(first), uint32(sqe.UserData))
+	require.NotEqual(t, first, sqe.UserData)
+	require.Nil(t, c.get(&giouring.CompletionQueueEvent{UserData: first}))
+	require.Nil(t, c.get(&giouring.CompletionQueueEvent{UserData: 1<<32 | 1234}))
+	c.get(&giouring.CompletionQueueEvent{UserData: sqe.UserData})(0, 0, nil)
+	require.Equal(t, []int{1, 1, 2}, fired)
+	require.Equal(t, 0, c.count())
+}
+
+func TestFixedFiles(t *testing.T) {
+	opt := testEpollOptions
+	opt.Backend = BackendAuto
+	opt.FixedFiles = 1
+	loop, err := New(opt)
+	require.NoError(t, err)
+	defer loop.Close()
+	if loop.Backend() != BackendIOUring {
+		t.Skip("io_uring not available")
+	}
+
+	var conns []*TCPConn
+	ln, err := loop.Listen("127.0.0.1:0", func(fd int, tc *TCPConn) {
+		require.Equal(t, fd, tc.Fd())
+		tc.Bind(&testEchoConn{tc: tc})
+		conns = append(conns, tc)
+	})
+	require.NoError(t, err)
+
+	// second connection doesn't fit into the table, uses regular fd
+	data := testRandomBuf(t, 64*1024)
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", ln.Port()))
+		require.NoError(t, err)
+		defer conn.Close()
+		echoed := make(chan []byte)
+		go func() {
+			_, err := conn.Write(data)
+			require.NoError(t, err)
+			rsp := make([]byte, len(data))
+			_, err = io.ReadFull(conn, rsp)
+			require.NoError(t, err)
+			echoed <- rsp
+		}()
+		for len(conns) == i {
+			require.NoError(t, loop.runOnce())
+		}
+		// registration completes with the first data
+		require.NoError(t, loop.runOnce())
+		if i == 0 {
+			require.Equal(t, 0, conns[0].fixed)
+		} else {
+			require.Equal(t, -1, conns[1].fixed)
+		}
+		for loop.stats.bytesSent.Load() < uint64((i+1)*len(data)) {
+			require.NoError(t, loop.runOnce())
+		}
+		require.Equal(t, data, <-echoed)
+	}
+	ln.close(true)
+	require.NoError(t, loop.runUntilDone())
+	require.Zero(t, loop.callbacks.count())
+}
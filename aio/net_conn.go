@@ -0,0 +1,313 @@
+package aio
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// netConnMaxBuffered is the number of received bytes NetConn buffers before
+// pausing receive on the tcp connection.
+const netConnMaxBuffered = 256 * 1024
+
+// NetConn is blocking net.Conn over the TCPConn. It allows using standard
+// library packages, which expect net.Conn, on the loop connections. Methods
+// are safe for concurrent use from any goroutine except the loop goroutine;
+// they post work to the loop and wait for the result.
+type NetConn struct {
+	tc     *TCPConn
+	loop   *Loop
+	local  net.Addr
+	remote net.Addr
+
+	mu       sync.Mutex
+	rbuf     []byte        // received, not yet read
+	paused   bool          // recv is paused because rbuf is full
+	err      error         // connection closed reason
+	closed   bool          // Close called
+	readable chan struct{} // signaled when data is received
+	done     chan struct{} // closed when connection is closed
+	doneOnce sync.Once
+
+	rd deadline
+	wd deadline
+}
+
+// NewNetConn binds tc to the returned NetConn. It must be called in the loop
+// goroutine, usually from the accepted or dialed callback.
+func NewNetConn(tc *TCPConn) *NetConn {
+	c := &NetConn{
+		tc:       tc,
+		loop:     tc.loop,
+		readable: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	c.rd.init()
+	c.wd.init()
+	if sa, err := syscall.Getsockname(tc.fd); err == nil {
+		c.local = sockaddrToNetAddr(sa)
+	}
+	if sa, err := syscall.Getpeername(tc.fd); err == nil {
+		c.remote = sockaddrToNetAddr(sa)
+	}
+	tc.Bind((*netConnUpstream)(c))
+	return c
+}
+
+// Read reads received data into b. It blocks until some data is available,
+// connection is closed or read deadline expires.
+func (c *NetConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			return 0, net.ErrClosed
+		}
+		if len(c.rbuf) > 0 {
+			n := copy(b, c.rbuf)
+			c.rbuf = c.rbuf[n:]
+			if len(c.rbuf) == 0 {
+				c.rbuf = nil
+			} else {
+				c.signalReadable()
+			}
+			if c.paused && len(c.rbuf) < netConnMaxBuffered {
+				c.paused = false
+				c.loop.Post(c.tc.ResumeRecv)
+			}
+			return n, nil
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if isClosedChan(c.rd.wait()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.readable:
+		case <-c.done:
+		case <-c.rd.wait():
+		}
+		c.mu.Lock()
+	}
+}
+
+// Write sends b to the connection and blocks until it is written, write
+// deadline expires, connection is closed or loop stops. On deadline data may
+// be partially written.
+func (c *NetConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	closed, err := c.closed, c.err
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if err != nil {
+		return 0, err
+	}
+	if isClosedChan(c.wd.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	// b can be modified after Write returns on deadline
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	type result struct {
+		n   int
+		err error
+	}
+	ch := make(chan result, 1)
+	c.loop.Post(func() {
+		c.tc.SendFunc(data, func(n int, err error) {
+			ch <- result{n: n, err: err}
+		})
+	})
+	select {
+	case r := <-ch:
+		return r.n, c.connError(r.err)
+	case <-c.wd.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.done:
+	case <-c.loop.runExit:
+	}
+	// closed or loop stopped, posted send may never run
+	select {
+	case r := <-ch:
+		return r.n, c.connError(r.err)
+	default:
+	}
+	c.mu.Lock()
+	closed, err = c.closed, c.err
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, ErrLoopShutdown
+}
+
+// Close closes the connection. Blocked Read and Write calls are unblocked.
+func (c *NetConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.rbuf = nil
+	c.mu.Unlock()
+	c.closeDone()
+	c.loop.Post(c.tc.Close)
+	return nil
+}
+
+func (c *NetConn) LocalAddr() net.Addr  { return c.local }
+func (c *NetConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *NetConn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	c.wd.set(t)
+	return nil
+}
+
+func (c *NetConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+func (c *NetConn) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t)
+	return nil
+}
+
+// connError converts tcp connection close reason to the error returned from
+// Read or Write.
+func (c *NetConn) connError(err error) error {
+	if errors.Is(err, ErrUpstreamClose) {
+		return net.ErrClosed
+	}
+	return err
+}
+
+func (c *NetConn) signalReadable() {
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+func (c *NetConn) closeDone() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// netConnUpstream handles tcp connection events in the loop goroutine.
+type netConnUpstream NetConn
+
+func (u *netConnUpstream) Received(buf []byte) {
+	c := (*NetConn)(u)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.rbuf = append(c.rbuf, buf...)
+	if !c.paused && len(c.rbuf) >= netConnMaxBuffered {
+		c.paused = true
+		c.tc.PauseRecv()
+	}
+	c.signalReadable()
+}
+
+func (u *netConnUpstream) Closed(err error) {
+	c := (*NetConn)(u)
+	c.mu.Lock()
+	c.err = c.connError(err)
+	c.mu.Unlock()
+	c.closeDone()
+}
+
+func (u *netConnUpstream) Sent() {}
+
+// deadline is read or write deadline, wait returns channel closed when the
+// deadline expires. Same as in the net.Pipe implementation.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func (d *deadline) init() {
+	d.cancel = make(chan struct{})
+}
+
+// set sets the deadline, zero t means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func sockaddrToNetAddr(sa syscall.Sockaddr) net.Addr {
+	switch v := sa.(type) {
+	case *syscall.SockaddrInet4, *syscall.SockaddrInet6:
+		return net.TCPAddrFromAddrPort(sockaddrToAddrPort(v))
+	case *syscall.SockaddrUnix:
+		return &net.UnixAddr{Name: v.Name, Net: "unix"}
+	}
+	return nil
+}
+
+var (
+	_ net.Conn = (*NetConn)(nil)
+	_ Upstream = (*netConnUpstream)(nil)
+)
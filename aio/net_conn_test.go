@@ -0,0 +1,116 @@
+package aio
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetConn(t *testing.T) {
+	// echo server
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		require.NoError(t, err)
+		_, _ = io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan error)
+	go func() { runDone <- loop.Run(ctx) }()
+
+	dialed := make(chan *NetConn)
+	loop.Post(func() {
+		require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+			require.NoError(t, err)
+			dialed <- NewNetConn(tc)
+		}))
+	})
+	nc := <-dialed
+	require.Equal(t, listen.Addr().String(), nc.RemoteAddr().String())
+	require.Equal(t, "tcp", nc.LocalAddr().Network())
+
+	// more than netConnMaxBuffered, recv is paused and resumed
+	data := testRandomBuf(t, 4*netConnMaxBuffered)
+	written := make(chan error)
+	go func() {
+		_, err := nc.Write(data)
+		written <- err
+	}()
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(nc, buf)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.NoError(t, <-written)
+
+	require.NoError(t, nc.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = nc.Read(buf)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NoError(t, nc.SetReadDeadline(time.Time{}))
+
+	// close unblocks read
+	readErr := make(chan error)
+	go func() {
+		_, err := nc.Read(buf)
+		readErr <- err
+	}()
+	require.NoError(t, nc.Close())
+	require.ErrorIs(t, <-readErr, net.ErrClosed)
+	_, err = nc.Write(data)
+	require.ErrorIs(t, err, net.ErrClosed)
+	require.ErrorIs(t, nc.Close(), net.ErrClosed)
+
+	cancel()
+	require.NoError(t, <-runDone)
+}
+
+func TestNetConnWriteLoopStopped(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	dial := func() *NetConn {
+		var nc *NetConn
+		require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+			require.NoError(t, err)
+			nc = NewNetConn(tc)
+		}))
+		for nc == nil {
+			require.NoError(t, loop.runOnce())
+		}
+		return nc
+	}
+
+	// loop is not running, posted send is never executed, close unblocks
+	// write
+	nc := dial()
+	written := make(chan error)
+	go func() {
+		_, err := nc.Write([]byte("foo"))
+		written <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, nc.Close())
+	require.ErrorIs(t, <-written, net.ErrClosed)
+
+	// Run returned
+	nc = dial()
+	loop.runExitOnce.Do(func() { close(loop.runExit) })
+	_, err = nc.Write([]byte("foo"))
+	require.ErrorIs(t, err, ErrLoopShutdown)
+}
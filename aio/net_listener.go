@@ -0,0 +1,114 @@
+package aio
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// NetListener is net.Listener over the TCPListener. Accepted connections are
+// NetConn adapters. It allows running http.Server on the loop:
+//
+//	ln, err := loop.NetListen(":8080")
+//	...
+//	go loop.Run(ctx)
+//	http.Serve(ln, handler)
+type NetListener struct {
+	ln    *TCPListener
+	loop  *Loop
+	addr  net.Addr
+	conns chan *NetConn // accepted, waiting for Accept
+	done  chan struct{} // closed by Close
+	once  sync.Once
+}
+
+// NetListen starts listening on addr, see Listen. It must be called in the
+// loop goroutine or before loop is started.
+func (l *Loop) NetListen(addr string) (*NetListener, error) {
+	return l.NetListenWith(addr, DefaultListenConfig)
+}
+
+// NetListenWith is NetListen with listening socket options.
+func (l *Loop) NetListenWith(addr string, cfg ListenConfig) (*NetListener, error) {
+	backlog := cfg.Backlog
+	if backlog <= 0 {
+		backlog = DefaultListenConfig.Backlog
+	}
+	nl := &NetListener{
+		loop:  l,
+		conns: make(chan *NetConn, backlog),
+		done:  make(chan struct{}),
+	}
+	ln, err := l.ListenWith(addr, cfg, nl.accepted)
+	if err != nil {
+		return nil, err
+	}
+	nl.ln = ln
+	if sa, err := syscall.Getsockname(ln.fd); err == nil {
+		nl.addr = sockaddrToNetAddr(sa)
+	}
+	return nl, nil
+}
+
+// accepted is called in the loop goroutine for each accepted connection
+func (nl *NetListener) accepted(fd int, tc *TCPConn) {
+	nc := NewNetConn(tc)
+	select {
+	case <-nl.done:
+		tc.Close()
+		return
+	default:
+	}
+	select {
+	case nl.conns <- nc:
+	default:
+		// Accept is not keeping up, same as full kernel backlog
+		slog.Debug("net listener backlog full", "fd", fd)
+		tc.Close()
+	}
+}
+
+// Accept waits for and returns the next connection.
+func (nl *NetListener) Accept() (net.Conn, error) {
+	select {
+	case <-nl.done:
+		return nil, net.ErrClosed
+	default:
+	}
+	select {
+	case nc := <-nl.conns:
+		return nc, nil
+	case <-nl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening. Already accepted connections are not closed, except
+// ones not yet returned from Accept.
+func (nl *NetListener) Close() error {
+	err := net.ErrClosed
+	nl.once.Do(func() {
+		err = nil
+		close(nl.done)
+		nl.loop.Post(func() {
+			nl.ln.close(false)
+			for {
+				select {
+				case nc := <-nl.conns:
+					nc.tc.Close()
+				default:
+					return
+				}
+			}
+		})
+	})
+	return err
+}
+
+// Addr returns listener network address.
+func (nl *NetListener) Addr() net.Addr {
+	return nl.addr
+}
+
+var _ net.Listener = (*NetListener)(nil)
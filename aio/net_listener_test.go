@@ -0,0 +1,48 @@
+package aio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetListenerHTTP(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+	ln, err := loop.NetListen("127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan error)
+	go func() { runDone <- loop.Run(ctx) }()
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	})}
+	serveDone := make(chan error)
+	go func() { serveDone <- srv.Serve(ln) }()
+
+	url := fmt.Sprintf("http://%s", ln.Addr())
+	for i := 0; i < 3; i++ {
+		rsp, err := http.Get(fmt.Sprintf("%s/%d", url, i))
+		require.NoError(t, err)
+		body, err := io.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		rsp.Body.Close()
+		require.Equal(t, fmt.Sprintf("hello /%d", i), string(body))
+	}
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	require.ErrorIs(t, <-serveDone, http.ErrServerClosed)
+	_, err = ln.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+	require.ErrorIs(t, ln.Close(), net.ErrClosed)
+
+	cancel()
+	require.NoError(t, <-runDone)
+}
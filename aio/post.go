@@ -0,0 +1,121 @@
+package aio
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/pawelgaczynski/giouring"
+	"golang.org/x/sys/unix"
+)
+
+// Reserved user data values for loop internal operations. Callbacks user data
+// are above math.MaxUint32, see callbacks.
+const (
+	postUserData uint64 = 1
+)
+
+// posted is queue of functions posted from other goroutines. Eventfd is used
+// to wake up the loop when new function is posted.
+type posted struct {
+	mu      sync.Mutex
+	fns     []func()
+	stopped bool    // loop is not running any more, functions are dropped
+	fd      int     // eventfd
+	buf     [8]byte // eventfd read buffer
+	pinner  runtime.Pinner
+}
+
+func (p *posted) init() error {
+	fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	p.fd = fd
+	p.pinner.Pin(&p.buf)
+	return nil
+}
+
+// push queues fn, returns false if loop is stopped
+func (p *posted) push(fn func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return false
+	}
+	p.fns = append(p.fns, fn)
+	if len(p.fns) == 1 {
+		// first in the queue, loop needs to be notified
+		p.wake()
+	}
+	return true
+}
+
+func (p *posted) pop() []func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fns := p.fns
+	p.fns = nil
+	return fns
+}
+
+// wake writes to the eventfd, called under the mutex so fd is not closed
+func (p *posted) wake() {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], 1)
+	if _, err := unix.Write(p.fd, buf[:]); err != nil {
+		slog.Debug("post wake", "fd", p.fd, "err", err)
+	}
+}
+
+// stop drops queued functions and all posted after
+func (p *posted) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	p.fns = nil
+}
+
+func (p *posted) deinit() {
+	p.stop()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fd >= 0 {
+		_ = unix.Close(p.fd)
+		p.fd = -1
+	}
+	p.pinner.Unpin()
+}
+
+// Post queues fn to be called in the loop goroutine. It is safe to call Post
+// from any goroutine. Loop is woken immediately, fn is called in the next loop
+// iteration.
+// That is the way to call any other loop or connection method from outside
+// of the loop goroutine.
+// Returns false, and fn is never called, after Run returns or loop is closed.
+func (l *Loop) Post(fn func()) bool {
+	return l.posted.push(fn)
+}
+
+// runPosted calls all functions posted since last run and rearms eventfd read.
+func (l *Loop) runPosted(err *ErrErrno) {
+	if err != nil && !err.Temporary() {
+		slog.Warn("post read", "fd", l.posted.fd, "err", err)
+	} else {
+		l.preparePostedRead()
+	}
+	for _, fn := range l.posted.pop() {
+		fn()
+	}
+}
+
+// preparePostedRead starts eventfd read with reserved user data.
+func (l *Loop) preparePostedRead() {
+	l.prepare(func(sqe *giouring.SubmissionQueueEntry) {
+		buf := &l.posted.buf
+		sqe.PrepareRead(l.posted.fd, uintptr(unsafe.Pointer(&buf[0])), uint32(len(buf)), 0)
+		sqe.UserData = postUserData
+	})
+}
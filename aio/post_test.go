@@ -0,0 +1,62 @@
+package aio
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPost(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	loopDone := make(chan struct{})
+	go func() {
+		require.NoError(t, loop.Run(ctx))
+		close(loopDone)
+	}()
+
+	// wait for the loop to start and block in wait for completions
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	called := make(chan struct{})
+	loop.Post(func() { close(called) })
+	<-called
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	// post from many goroutines
+	const goroutines, posts = 16, 1000
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < posts; j++ {
+				loop.Post(func() { counter++ })
+			}
+		}()
+	}
+	wg.Wait()
+	loop.Post(cancel)
+	<-loopDone
+	require.Equal(t, goroutines*posts, counter)
+
+	// dropped after Run returns
+	require.False(t, loop.Post(func() { t.Fatal("posted after Run returned") }))
+}
+
+func TestPostAfterClose(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	require.True(t, loop.Post(func() {}))
+	loop.Close()
+	// eventfd is closed, must not be written
+	require.False(t, loop.Post(func() {}))
+	require.Equal(t, -1, loop.posted.fd)
+}
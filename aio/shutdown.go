@@ -0,0 +1,187 @@
+package aio
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"syscall"
+)
+
+// ErrLoopShutdown is passed to the upstream Closed when connection is closed
+// because of the loop shutdown.
+var ErrLoopShutdown = errors.New("loop shutdown")
+
+// ShutdownReport describes how connections were closed during shutdown.
+type ShutdownReport struct {
+	// Clean is number of connections closed after all pending sends were
+	// written, or closed by the peer during shutdown.
+	Clean int
+	// Forced is number of connections closed on the shutdown deadline with
+	// unsent data.
+	Forced int
+}
+
+// shutdownState is loop state during graceful shutdown
+type shutdownState struct {
+	report  ShutdownReport
+	pending map[*TCPConn]struct{} // connections waiting for sends to flush
+	forced  bool
+	done    chan ShutdownReport // set when shutdown is started by Shutdown
+	stopCtx func() bool
+}
+
+// Shutdown gracefully stops the running loop. It stops all listeners, lets
+// connections flush pending sends and then closes them. When ctx is done
+// connections which are still sending are closed forcefully.
+// Returns when loop is stopped and Run returns. Safe to call from any
+// goroutine. If the loop is not running Shutdown returns when ctx is done, if
+// Run returns with error before shutdown is finished Shutdown returns error.
+func (l *Loop) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	started := make(chan struct{})
+	done := make(chan ShutdownReport, 1)
+	l.Post(func() {
+		close(started)
+		if l.shutdown != nil {
+			close(done) // already shutting down
+			return
+		}
+		l.startShutdown(ctx)
+		l.shutdown.done = done
+	})
+	select {
+	case <-started:
+	case <-ctx.Done():
+		return ShutdownReport{}, ctx.Err()
+	case <-l.runExit:
+		return ShutdownReport{}, errors.New("loop is not running")
+	}
+	// once started, ctx done forces loop to close remaining connections
+	select {
+	case report, ok := <-done:
+		return shutdownResult(report, ok)
+	case <-l.runExit:
+		select {
+		case report, ok := <-done:
+			return shutdownResult(report, ok)
+		default:
+		}
+		return ShutdownReport{}, errors.New("loop stopped before shutdown finished")
+	}
+}
+
+func shutdownResult(report ShutdownReport, ok bool) (ShutdownReport, error) {
+	if !ok {
+		return report, errors.New("loop shutdown already in progress")
+	}
+	return report, nil
+}
+
+// startShutdown stops accepting new connections, closes connections without
+// pending sends and waits for others to flush until ctx is done.
+func (l *Loop) startShutdown(ctx context.Context) {
+	s := &shutdownState{pending: make(map[*TCPConn]struct{})}
+	l.shutdown = s
+	l.stopTimers()
+	for d := range l.dials {
+		d.cancel(ErrLoopShutdown)
+	}
+	for _, lsn := range l.listeners {
+		for _, conn := range lsn.connections {
+			l.closeGraceful(conn)
+		}
+		lsn.close(false)
+	}
+	for _, conn := range l.connections {
+		l.closeGraceful(conn)
+	}
+	for _, conn := range l.udpConns {
+		conn.Close()
+	}
+	if ctx.Err() != nil {
+		l.forceShutdown()
+		return
+	}
+	s.stopCtx = context.AfterFunc(ctx, func() { l.Post(l.forceShutdown) })
+}
+
+// closeGraceful closes connection when all pending sends are written.
+func (l *Loop) closeGraceful(tc *TCPConn) {
+	if tc.shutdownError != nil {
+		return
+	}
+	if !tc.flushed() {
+		l.shutdown.pending[tc] = struct{}{}
+		tc.onFlushed = func() {
+			delete(l.shutdown.pending, tc)
+			l.shutdown.report.Clean++
+			tc.shutdown(ErrLoopShutdown)
+		}
+		return
+	}
+	l.shutdown.report.Clean++
+	tc.shutdown(ErrLoopShutdown)
+}
+
+// forceShutdown closes all connections still waiting for sends to flush.
+func (l *Loop) forceShutdown() {
+	s := l.shutdown
+	if s == nil || s.forced {
+		return
+	}
+	s.forced = true
+	for tc := range s.pending {
+		delete(s.pending, tc)
+		s.report.Forced++
+		tc.shutdown(ErrLoopShutdown)
+	}
+}
+
+// connClosed is called when connection is closed during shutdown.
+func (l *Loop) connClosed(tc *TCPConn) {
+	s := l.shutdown
+	if s == nil {
+		return
+	}
+	if _, ok := s.pending[tc]; ok {
+		// closed by peer or upstream while waiting to flush
+		delete(s.pending, tc)
+		s.report.Clean++
+	}
+}
+
+// finishShutdown is called when all loop operations are finished.
+func (l *Loop) finishShutdown() {
+	s := l.shutdown
+	if s == nil {
+		return
+	}
+	if s.stopCtx != nil {
+		s.stopCtx()
+	}
+	slog.Debug("loop shutdown", "clean", s.report.Clean, "forced", s.report.Forced)
+	if s.done != nil {
+		s.done <- s.report
+	}
+}
+
+// closeRemaining closes listeners and connections which are left without any
+// operation in the kernel. Should not happen, last line of defense instead
+// of leaking file descriptors.
+func (l *Loop) closeRemaining() {
+	slog.Warn("unclean shutdown", "listeners", len(l.listeners), "connections", len(l.connections))
+	for fd, lsn := range l.listeners {
+		for cfd := range lsn.connections {
+			_ = syscall.Close(cfd)
+		}
+		_ = syscall.Close(fd)
+		delete(l.listeners, fd)
+		l.stats.listeners.Add(-1)
+	}
+	for fd := range l.connections {
+		_ = syscall.Close(fd)
+		delete(l.connections, fd)
+		if l.shutdown != nil {
+			l.shutdown.report.Forced++
+		}
+	}
+}
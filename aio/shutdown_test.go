@@ -0,0 +1,140 @@
+package aio
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoopShutdown(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+	// peer accepts connections but never reads
+	peers := make(chan net.Conn, 3)
+	go func() {
+		for i := 0; i < cap(peers); i++ {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			peers <- conn
+		}
+	}()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	_, err = loop.Listen("127.0.0.1:0", func(fd int, tc *TCPConn) {})
+	require.NoError(t, err)
+
+	dialed := make(chan struct{}, 3)
+	conns := make([]*testCloseErrConn, 3)
+	for i := range conns {
+		i := i
+		require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+			require.NoError(t, err)
+			conns[i] = &testCloseErrConn{}
+			tc.Bind(conns[i])
+			switch i {
+			case 1:
+				// small send which fits into socket buffers
+				tc.Send([]byte("bye"))
+			case 2:
+				// large send which will never be read by the peer
+				tc.Send(make([]byte, 64*1024*1024))
+			}
+			dialed <- struct{}{}
+		}))
+	}
+
+	runDone := make(chan error)
+	go func() { runDone <- loop.Run(context.Background()) }()
+	for range conns {
+		<-dialed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report, err := loop.Shutdown(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ShutdownReport{Clean: 2, Forced: 1}, report)
+	require.NoError(t, <-runDone)
+
+	for _, conn := range conns {
+		require.ErrorIs(t, conn.err, ErrLoopShutdown)
+		(<-peers).Close()
+	}
+	stats := loop.Stats()
+	require.Equal(t, int64(0), stats.Connections)
+	require.Equal(t, int64(0), stats.Listeners)
+	require.Equal(t, uint64(3), stats.Dialed)
+	require.Equal(t, uint64(3), stats.Closed)
+}
+
+func TestLoopRunCancel(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	accepted := &testCloseErrConn{}
+	ln, err := loop.Listen("127.0.0.1:0", func(fd int, tc *TCPConn) { tc.Bind(accepted) })
+	require.NoError(t, err)
+	dialed := &testCloseErrConn{}
+	ready := make(chan struct{}, 2)
+	require.NoError(t, loop.Dial(listen.Addr().String(), func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		tc.Bind(dialed)
+		ready <- struct{}{}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan error)
+	go func() { runDone <- loop.Run(ctx) }()
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+	peer, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", ln.Port()))
+	require.NoError(t, err)
+	defer peer.Close()
+	<-ready
+	for loop.Stats().Accepted == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// plain cancel closes connections without loop shutdown error
+	cancel()
+	require.NoError(t, <-runDone)
+	require.ErrorIs(t, dialed.err, ErrUpstreamClose)
+	require.ErrorIs(t, accepted.err, ErrListenerClose)
+
+	// loop is not running
+	_, err = loop.Shutdown(context.Background())
+	require.Error(t, err)
+}
+
+func TestLoopShutdownNotRunning(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = loop.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
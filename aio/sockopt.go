@@ -0,0 +1,147 @@
+package aio
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// SocketOptions are applied to the tcp socket. Zero value leaves operating
+// system defaults.
+type SocketOptions struct {
+	NoDelay bool // disable Nagle's algorithm, TCP_NODELAY
+	// KeepAlive enables tcp keepalive probes. Connection is probed after being
+	// idle for KeepAlive and then in KeepAlive intervals.
+	KeepAlive  time.Duration
+	RecvBuffer int // SO_RCVBUF
+	SendBuffer int // SO_SNDBUF
+}
+
+// ListenConfig are listening socket options.
+type ListenConfig struct {
+	Backlog   int
+	ReuseAddr bool // SO_REUSEADDR
+	ReusePort bool // SO_REUSEPORT, required for Group.Listen
+	V6Only    bool // IPV6_V6ONLY, accept only ip6 connections on the ip6 socket
+	// DeferAccept delays accept until data arrives on the connection or
+	// timeout expires, TCP_DEFER_ACCEPT.
+	DeferAccept time.Duration
+	// Socket options are set on each accepted connection. Buffer sizes are
+	// also set on the listening socket, so they are effective during the
+	// handshake.
+	Socket SocketOptions
+}
+
+var DefaultListenConfig = ListenConfig{
+	Backlog:   128,
+	ReuseAddr: true,
+	ReusePort: true,
+}
+
+// apply sets socket options on fd. Tcp level options are skipped for unix
+// domain sockets.
+func (o SocketOptions) apply(fd int, domain int) error {
+	if err := o.applyBuffers(fd); err != nil {
+		return err
+	}
+	if domain == syscall.AF_UNIX {
+		return nil
+	}
+	if o.NoDelay {
+		if err := setNoDelay(fd, true); err != nil {
+			return err
+		}
+	}
+	if o.KeepAlive > 0 {
+		if err := setKeepAlive(fd, o.KeepAlive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o SocketOptions) applyBuffers(fd int) error {
+	if o.RecvBuffer > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply sets listening socket options before bind.
+func (c ListenConfig) apply(fd int, domain int) error {
+	if err := c.Socket.applyBuffers(fd); err != nil {
+		return err
+	}
+	if domain == syscall.AF_UNIX {
+		return nil
+	}
+	if c.ReuseAddr {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return err
+		}
+	}
+	if c.ReusePort {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return err
+		}
+	}
+	if c.V6Only && domain == syscall.AF_INET6 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1); err != nil {
+			return err
+		}
+	}
+	if c.DeferAccept > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, durationSeconds(c.DeferAccept)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setNoDelay(fd int, noDelay bool) error {
+	v := 0
+	if noDelay {
+		v = 1
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, v)
+}
+
+// setKeepAlive enables keepalive with d as idle time and probe interval, or
+// disables it if d is not positive.
+func setKeepAlive(fd int, d time.Duration) error {
+	if d <= 0 {
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+		return err
+	}
+	secs := durationSeconds(d)
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, secs); err != nil {
+		return err
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+}
+
+// durationSeconds rounds d up to whole seconds
+func durationSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// SetNoDelay controls Nagle's algorithm on the connection.
+func (tc *TCPConn) SetNoDelay(noDelay bool) error {
+	return setNoDelay(tc.fd, noDelay)
+}
+
+// SetKeepAlive enables tcp keepalive probes after the connection is idle for
+// d, and then in d intervals. Not positive d disables keepalive.
+func (tc *TCPConn) SetKeepAlive(d time.Duration) error {
+	return setKeepAlive(tc.fd, d)
+}
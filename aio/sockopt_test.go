@@ -0,0 +1,83 @@
+package aio
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenWithSocketOptions(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	cfg := DefaultListenConfig
+	cfg.V6Only = true
+	cfg.DeferAccept = time.Second
+	cfg.Socket = SocketOptions{NoDelay: true, KeepAlive: 30 * time.Second, RecvBuffer: 64 * 1024}
+	accepted := make(chan struct{})
+	lsn, err := loop.ListenWith("[::1]:0", cfg, func(fd int, tc *TCPConn) {
+		requireSockopt(t, fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+		requireSockopt(t, fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+		requireSockopt(t, fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, 30)
+		require.NoError(t, tc.SetNoDelay(false))
+		requireSockopt(t, fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0)
+		require.NoError(t, tc.SetKeepAlive(0))
+		requireSockopt(t, fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0)
+		tc.Bind(&testConn{})
+		tc.Close()
+		close(accepted)
+	})
+	require.NoError(t, err)
+	requireSockopt(t, lsn.fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+
+	go func() {
+		conn, err := net.Dial("tcp", fmt.Sprintf("[::1]:%d", lsn.Port()))
+		require.NoError(t, err)
+		// deferred accept waits for data
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		conn.Close()
+	}()
+	for {
+		select {
+		case <-accepted:
+			lsn.Close()
+			require.NoError(t, loop.runUntilDone())
+			return
+		default:
+			require.NoError(t, loop.runOnce())
+		}
+	}
+}
+
+func TestDialWithSocketOptions(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listen.Close()
+
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	cfg := DialConfig{Socket: SocketOptions{NoDelay: true, KeepAlive: time.Minute}}
+	require.NoError(t, loop.DialContext(context.Background(), listen.Addr().String(), cfg, func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		requireSockopt(t, fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+		requireSockopt(t, fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 60)
+		tc.Bind(&testConn{})
+		tc.Close()
+	}))
+	require.NoError(t, loop.runUntilDone())
+}
+
+func requireSockopt(t *testing.T, fd, level, opt, expected int) {
+	v, err := syscall.GetsockoptInt(fd, level, opt)
+	require.NoError(t, err)
+	require.Equal(t, expected, v)
+}
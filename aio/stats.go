@@ -0,0 +1,171 @@
+package aio
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Stats is snapshot of the loop counters and gauges.
+type Stats struct {
+	// gauges
+	Connections int64 // currently open tcp connections, accepted and dialed
+	Listeners   int64 // currently active tcp listeners
+	InFlight    int64 // operations submitted to the kernel and not yet completed
+	Pending     int64 // operations waiting for free submission queue entry
+
+	// counters
+	Submitted     uint64 // operations prepared in the submission queue
+	Completed     uint64 // completion queue events processed
+	Accepted      uint64 // accepted tcp connections
+	Dialed        uint64 // successfully dialed tcp connections
+	Closed        uint64 // closed tcp connections
+	BytesSent     uint64 // bytes sent by tcp and udp connections
+	BytesReceived uint64 // bytes received by tcp and udp connections
+	NoBuffers     uint64 // recv failed because provided buffers were exhausted (ENOBUFS)
+	RecvRestarts  uint64 // multishot recv terminated by the kernel and prepared again
+
+	Buffers []BufferStats // usage of each provided buffers group
+}
+
+// loopStats are updated in the loop goroutine and can be read from any other.
+type loopStats struct {
+	connections atomic.Int64
+	listeners   atomic.Int64
+	inFlight    atomic.Int64
+	pending     atomic.Int64
+
+	submitted     atomic.Uint64
+	completed     atomic.Uint64
+	accepted      atomic.Uint64
+	dialed        atomic.Uint64
+	closed        atomic.Uint64
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+	noBuffers     atomic.Uint64
+	recvRestarts  atomic.Uint64
+}
+
+// Stats returns current loop counters. Safe to call from any goroutine.
+func (l *Loop) Stats() Stats {
+	s := &l.stats
+	return Stats{
+		Connections:   s.connections.Load(),
+		Listeners:     s.listeners.Load(),
+		InFlight:      s.inFlight.Load(),
+		Pending:       s.pending.Load(),
+		Submitted:     s.submitted.Load(),
+		Completed:     s.completed.Load(),
+		Accepted:      s.accepted.Load(),
+		Dialed:        s.dialed.Load(),
+		Closed:        s.closed.Load(),
+		BytesSent:     s.bytesSent.Load(),
+		BytesReceived: s.bytesReceived.Load(),
+		NoBuffers:     s.noBuffers.Load(),
+		RecvRestarts:  s.recvRestarts.Load(),
+		Buffers:       l.bufferStats(),
+	}
+}
+
+func (l *Loop) bufferStats() []BufferStats {
+	stats := make([]BufferStats, len(l.buffers))
+	for i, b := range l.buffers {
+		stats[i] = b.stats()
+	}
+	return stats
+}
+
+// updateGauges stores ring state gauges, called from the loop goroutine.
+func (l *Loop) updateGauges() {
+	l.stats.inFlight.Store(int64(l.callbacks.count()))
+	l.stats.pending.Store(int64(len(l.pending)))
+}
+
+// #region prometheus exporter
+
+type metric struct {
+	name  string
+	typ   string
+	help  string
+	value func(s Stats) string
+}
+
+func gauge(name, help string, v func(s Stats) int64) metric {
+	return metric{name, "gauge", help, func(s Stats) string { return fmt.Sprint(v(s)) }}
+}
+
+func counter(name, help string, v func(s Stats) uint64) metric {
+	return metric{name, "counter", help, func(s Stats) string { return fmt.Sprint(v(s)) }}
+}
+
+var metrics = []metric{
+	gauge("aio_connections", "Currently open tcp connections.", func(s Stats) int64 { return s.Connections }),
+	gauge("aio_listeners", "Currently active tcp listeners.", func(s Stats) int64 { return s.Listeners }),
+	gauge("aio_in_flight_operations", "Operations submitted to the kernel and not yet completed.", func(s Stats) int64 { return s.InFlight }),
+	gauge("aio_pending_operations", "Operations waiting for free submission queue entry.", func(s Stats) int64 { return s.Pending }),
+	counter("aio_submitted_total", "Operations prepared in the submission queue.", func(s Stats) uint64 { return s.Submitted }),
+	counter("aio_completed_total", "Completion queue events processed.", func(s Stats) uint64 { return s.Completed }),
+	counter("aio_accepted_total", "Accepted tcp connections.", func(s Stats) uint64 { return s.Accepted }),
+	counter("aio_dialed_total", "Successfully dialed tcp connections.", func(s Stats) uint64 { return s.Dialed }),
+	counter("aio_closed_total", "Closed tcp connections.", func(s Stats) uint64 { return s.Closed }),
+	counter("aio_sent_bytes_total", "Bytes sent by tcp and udp connections.", func(s Stats) uint64 { return s.BytesSent }),
+	counter("aio_received_bytes_total", "Bytes received by tcp and udp connections.", func(s Stats) uint64 { return s.BytesReceived }),
+	counter("aio_no_buffers_total", "Receives failed because provided buffers were exhausted.", func(s Stats) uint64 { return s.NoBuffers }),
+	counter("aio_recv_restarts_total", "Multishot receives terminated by the kernel and prepared again.", func(s Stats) uint64 { return s.RecvRestarts }),
+}
+
+type bufferMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(s BufferStats) uint64
+}
+
+var bufferMetrics = []bufferMetric{
+	{"aio_buffers", "gauge", "Allocated provided buffers.", func(s BufferStats) uint64 { return uint64(s.Count) }},
+	{"aio_buffers_max", "gauge", "Maximum number of provided buffers group can grow to.", func(s BufferStats) uint64 { return uint64(s.MaxCount) }},
+	{"aio_buffer_bytes", "gauge", "Length of each provided buffer.", func(s BufferStats) uint64 { return uint64(s.Len) }},
+	{"aio_buffers_exhausted_total", "counter", "Receives failed because buffer group was exhausted.", func(s BufferStats) uint64 { return s.Exhausted }},
+	{"aio_buffers_grown_total", "counter", "Buffer group expansions.", func(s BufferStats) uint64 { return s.Grown }},
+}
+
+// WritePrometheus writes stats in the Prometheus text exposition format. Each
+// stats sample is labeled with its index as loop label, so stats of all group
+// shards can be passed at once.
+func WritePrometheus(w io.Writer, stats ...Stats) error {
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ); err != nil {
+			return err
+		}
+		for i, s := range stats {
+			if _, err := fmt.Fprintf(w, "%s{loop=\"%d\"} %s\n", m.name, i, m.value(s)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range bufferMetrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ); err != nil {
+			return err
+		}
+		for i, s := range stats {
+			for _, b := range s.Buffers {
+				if _, err := fmt.Fprintf(w, "%s{loop=\"%d\",group=\"%d\"} %d\n", m.name, i, b.Group, m.value(b)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// PrometheusHandler returns http handler which serves stats returned by the
+// stats func, for example Group.Stats.
+func PrometheusHandler(stats func() []Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = WritePrometheus(w, stats()...)
+	})
+}
+
+// #endregion
@@ -0,0 +1,20 @@
+package aio
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WritePrometheus(&buf,
+		Stats{Connections: 2, BytesSent: 1024},
+		Stats{Connections: 3, NoBuffers: 1},
+	))
+	out := buf.String()
+	require.Contains(t, out, "# TYPE aio_connections gauge\naio_connections{loop=\"0\"} 2\naio_connections{loop=\"1\"} 3\n")
+	require.Contains(t, out, "# TYPE aio_sent_bytes_total counter\naio_sent_bytes_total{loop=\"0\"} 1024\n")
+	require.Contains(t, out, "aio_no_buffers_total{loop=\"1\"} 1\n")
+}
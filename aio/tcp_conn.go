@@ -2,15 +2,22 @@ package aio
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"runtime"
 	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pawelgaczynski/giouring"
 )
 
 var (
 	ErrListenerClose = errors.New("listener closed connection")
 	ErrUpstreamClose = errors.New("upstream closed connection")
+	ErrTimeout       = errors.New("timeout")
+	ErrWriteClosed   = errors.New("write side of the connection closed")
 )
 
 // upper layer's events handler interface
@@ -24,12 +31,101 @@ type TCPConn struct {
 	closedCallback func()
 	loop           *Loop
 	fd             int
+	fixed          int // registered file index, -1 if not registered
 	up             Upstream
 	shutdownError  error
+	buffers        *providedBuffers // recv buffer group
+
+	// recv state
+	recvCb       completionCallback
+	recvOp       operation
+	recvArmed    bool   // multishot recv is in the kernel
+	recvUserData uint64 // of the multishot recv, used to cancel it, zero until prepared
+	recvPaused   bool
+	held         [][]byte // received while pausing, delivered on resume
+	heldEOF      bool     // peer closed while there is held data
+
+	pipe [2]int // used by SendFile for splice, created on first use
+
+	// outbound queue
+	outq           []*outEntry
+	outqBuf        []*outEntry // outq backing array, reused when outq is empty
+	freeEntries    []*outEntry // sent entries for reuse
+	doneEntries    []*outEntry // written entries waiting for callbacks
+	queued         int         // bytes in the outq
+	writing        bool        // write in flight
+	writeClosed    bool        // CloseWrite called
+	writeShutdown  bool        // SHUT_WR is prepared
+	onFlushed      func()
+	highWaterMark  int
+	highWaterFn    func(above bool)
+	aboveHighWater bool
+
+	// write in flight, reused for each write
+	writeBuffers [][]byte
+	writeIovecs  []syscall.Iovec
+	writePinner  runtime.Pinner
+	writeOp      operation
+	writeCb      completionCallback
+	zeroCopy     int       // zero copy send threshold, zero when disabled
+	writeZC      bool      // write in flight is zero copy send
+	writeZCRes   int32     // zero copy send result, waiting for notification
+	writeZCErr   *ErrErrno // zero copy send error, waiting for notification
+	writeZCHeld  *outEntry // closed while waiting for notification
+
+	timeouts connTimeouts
 }
 
 func newTcpConn(loop *Loop, closedCallback func(), fd int) *TCPConn {
-	return &TCPConn{loop: loop, fd: fd, closedCallback: closedCallback}
+	loop.stats.connections.Add(1)
+	tc := &TCPConn{loop: loop, fd: fd, fixed: -1, buffers: loop.buffers[defaultBufferGroup], closedCallback: func() {
+		loop.stats.connections.Add(-1)
+		loop.stats.closed.Add(1)
+		closedCallback()
+	}}
+	// operations are prepared for each write and recv, create them once
+	tc.writeOp = tc.prepareWrite
+	tc.writeCb = tc.writeCompleted
+	tc.recvOp = tc.prepareRecv
+	if loop.features.fixedFiles {
+		tc.registerFile()
+	}
+	return tc
+}
+
+// registerFile registers connection fd in the loop registered files table.
+// Until registration completes, and if the table is full, operations use
+// regular fd.
+func (tc *TCPConn) registerFile() {
+	var pinner runtime.Pinner
+	index := new(int32)
+	*index = int32(tc.fd)
+	pinner.Pin(index)
+	tc.loop.prepareRegisterFile(index, func(res int32, flags uint32, err *ErrErrno) {
+		pinner.Unpin()
+		if err != nil {
+			slog.Debug("tcp conn register file", "fd", tc.fd, "err", err)
+			return
+		}
+		if tc.shutdownError != nil {
+			// closed in the meantime
+			tc.loop.prepareCloseFixed(int(*index), func(res int32, flags uint32, err *ErrErrno) {})
+			return
+		}
+		tc.fixed = int(*index)
+	})
+}
+
+// Fd returns connection file descriptor. Connection can also use registered
+// file, fd remains valid until connection is closed.
+func (tc *TCPConn) Fd() int {
+	return tc.fd
+}
+
+// Loop returns loop on which this connection is running. All connection
+// methods must be called from that loop goroutine, use Loop.Post from others.
+func (tc *TCPConn) Loop() *Loop {
+	return tc.loop
 }
 
 // Bind connects this connection and upstream handler. It's up to the
@@ -45,61 +141,355 @@ func (tc *TCPConn) Bind(up Upstream) {
 	}
 }
 
-// TODO: add correlation id (userdata) for send/sent connecting
+// SetBufferGroup selects provided buffers group used for receiving, see
+// Options.BufferGroups. Must be called before Bind.
+func (tc *TCPConn) SetBufferGroup(group uint16) error {
+	if tc.up != nil {
+		return errors.New("tcp conn already receiving")
+	}
+	b, err := tc.loop.bufferGroup(group)
+	if err != nil {
+		return err
+	}
+	tc.buffers = b
+	return nil
+}
+
+// Send sends data to the connection. Upstream Sent is called when all data is
+// written. Data must not be modified until then.
 func (tc *TCPConn) Send(data []byte) {
-	nn := 0 // number of bytes sent
-	var cb completionCallback
-	var pinner runtime.Pinner
-	pinner.Pin(&data[0])
-	cb = func(res int32, flags uint32, err *ErrErrno) {
-		nn += int(res) // bytes written so far
-		if err != nil {
-			pinner.Unpin()
-			tc.shutdown(err)
-			return
+	tc.SendBuffersFunc([][]byte{data}, nil)
+}
+
+// SendFunc is Send with completion callback for this specific send. Instead
+// of upstream Sent, sent is called with the number of bytes written and error
+// if send failed. Connection is closed on send error.
+func (tc *TCPConn) SendFunc(data []byte, sent func(n int, err error)) {
+	tc.SendBuffersFunc([][]byte{data}, sent)
+}
+
+// SendBuffers sends all buffers. Upstream Sent is called when all buffers are
+// written.
+func (tc *TCPConn) SendBuffers(buffers [][]byte) {
+	tc.SendBuffersFunc(buffers, nil)
+}
+
+// SendBuffersFunc is SendBuffers with completion callback for this specific
+// send. Instead of upstream Sent, sent is called with the number of bytes
+// written and error if send failed. Connection is closed on send error.
+//
+// Sends are queued and written in order. At most one write is in flight, all
+// sends queued in the meantime are written with the next single writev.
+func (tc *TCPConn) SendBuffersFunc(buffers [][]byte, sent func(n int, err error)) {
+	if tc.shutdownError != nil {
+		tc.sent(sent, 0, tc.shutdownError)
+		return
+	}
+	if tc.writeClosed {
+		tc.sent(sent, 0, ErrWriteClosed)
+		return
+	}
+	e := tc.newEntry()
+	e.sent = sent
+	for _, buf := range buffers {
+		if len(buf) == 0 {
+			continue
 		}
-		if nn >= len(data) {
-			pinner.Unpin()
-			tc.up.Sent() // all sent call callback
-			return
+		e.pinner.Pin(&buf[0])
+		e.buffers = append(e.buffers, buf)
+		e.len += len(buf)
+	}
+	tc.pushOut(e)
+	tc.queued += e.len
+	tc.checkHighWaterMark()
+	tc.flush()
+}
+
+// Queued returns number of bytes queued for sending, including ones in the
+// write currently in flight.
+func (tc *TCPConn) Queued() int {
+	return tc.queued
+}
+
+// SetHighWaterMark sets callback fired with true when number of queued bytes
+// exceeds n, and with false when it drops back to or below n. Upstream can
+// use it to stop producing data for the slow consumer.
+func (tc *TCPConn) SetHighWaterMark(n int, fn func(above bool)) {
+	tc.highWaterMark = n
+	tc.highWaterFn = fn
+	tc.checkHighWaterMark()
+}
+
+func (tc *TCPConn) checkHighWaterMark() {
+	if tc.highWaterFn == nil {
+		return
+	}
+	above := tc.queued > tc.highWaterMark
+	if above != tc.aboveHighWater {
+		tc.aboveHighWater = above
+		tc.highWaterFn(above)
+	}
+}
+
+// SetZeroCopy enables zero copy send for buffers of at least threshold bytes,
+// zero disables it. Kernel sends directly from the buffer instead of copying
+// it into the socket buffer. Sent, or send callback, is called when kernel
+// notifies that it is done with the buffer, which is later than for the
+// regular send. Zero copy pays off only for large buffers, tens of KB and
+// more. Returns error wrapping errors.ErrUnsupported if loop backend
+// doesn't support zero copy send.
+func (tc *TCPConn) SetZeroCopy(threshold int) error {
+	if threshold > 0 && !tc.loop.features.sendZC {
+		return fmt.Errorf("zero copy send: %w", errors.ErrUnsupported)
+	}
+	tc.zeroCopy = threshold
+	return nil
+}
+
+// flushed returns true if there is nothing to write
+func (tc *TCPConn) flushed() bool {
+	return len(tc.outq) == 0 && !tc.writing
+}
+
+// maxIovecs is the limit of buffers in the single writev
+const maxIovecs = 1024
+
+// flush writes all queued buffers if there is no write in flight.
+func (tc *TCPConn) flush() {
+	if tc.writing || tc.shutdownError != nil {
+		return
+	}
+	if len(tc.outq) > 0 && tc.outq[0].file != nil {
+		tc.flushFile(tc.outq[0])
+		return
+	}
+	if len(tc.outq) == 0 {
+		if tc.writeClosed && !tc.writeShutdown {
+			tc.shutdownWrite()
 		}
-		// send rest of the data
-		tc.loop.prepareSend(tc.fd, data[nn:], cb)
+		if tc.onFlushed != nil {
+			fn := tc.onFlushed
+			tc.onFlushed = nil
+			fn()
+		}
+		return
+	}
+	buffers := tc.writeBuffers[:0]
+	for _, e := range tc.outq {
+		if e.file != nil {
+			break // written after buffers in front of it
+		}
+		buffers = append(buffers, e.buffers...)
+		if len(buffers) >= maxIovecs {
+			buffers = buffers[:maxIovecs]
+			break
+		}
+	}
+	tc.writeZC = tc.zeroCopy > 0 && len(buffers) > 0 && len(buffers[0]) >= tc.zeroCopy
+	if tc.writeZC {
+		// large buffer alone, rest is written with the next write
+		buffers = buffers[:1]
 	}
-	tc.loop.prepareSend(tc.fd, data, cb)
+	tc.writeBuffers = buffers
+	if len(buffers) == 0 {
+		// only empty sends in front of the queue
+		tc.written(0)
+		tc.flush()
+		return
+	}
+	tc.writing = true
+	tc.writeIovecs = tc.writeIovecs[:0]
+	if len(buffers) > 1 {
+		tc.writeIovecs = buffersToIovec(tc.writeIovecs, buffers)
+		tc.writePinner.Pin(&tc.writeIovecs[0])
+	}
+	tc.loop.prepare(tc.writeOp)
 }
 
-func (tc *TCPConn) SendBuffers(buffers [][]byte) {
-	var cb completionCallback
-	var pinner runtime.Pinner
-	for _, buf := range buffers {
-		pinner.Pin(&buf[0])
+// prepareWrite prepares send of the single buffer or writev of the iovecs.
+// Buffers are pinned in the outbound queue entries.
+//
+// references from std lib:
+// https://github.com/golang/go/blob/140266fe7521bf75bf0037f12265190213cc8e7d/src/internal/poll/writev.go#L16
+// https://github.com/golang/go/blob/140266fe7521bf75bf0037f12265190213cc8e7d/src/internal/poll/fd_writev_unix.go#L20
+func (tc *TCPConn) prepareWrite(sqe *giouring.SubmissionQueueEntry) {
+	if iovecs := tc.writeIovecs; len(iovecs) > 0 {
+		sqe.PrepareWritev(tc.fd, uintptr(unsafe.Pointer(&iovecs[0])), uint32(len(iovecs)), 0)
+	} else if buf := tc.writeBuffers[0]; tc.writeZC {
+		sqe.PrepareSendZC(tc.fd, buf, 0, 0)
+		// giouring passes address of the slice header, fix it here
+		sqe.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	} else {
+		sqe.PrepareSend(tc.fd, uintptr(unsafe.Pointer(&buf[0])), uint32(len(buf)), 0)
 	}
-	cb = func(res int32, flags uint32, err *ErrErrno) {
-		n := int(res)
-		if err != nil {
-			pinner.Unpin()
-			tc.shutdown(err)
-			return
+	useFixed(sqe, tc.fixed)
+	tc.loop.callbacks.set(sqe, tc.writeCb)
+}
+
+func (tc *TCPConn) writeCompleted(res int32, flags uint32, err *ErrErrno) {
+	if tc.writeZC {
+		// Zero copy send completes in two stages. First with the send
+		// result and, if more flag is set, later with the notification
+		// that kernel is done with the buffer.
+		if flags&giouring.CQEFNotif == 0 {
+			tc.writeZCRes, tc.writeZCErr = res, err
+			if isMultiShot(flags) {
+				return
+			}
+		}
+		res, err = tc.writeZCRes, tc.writeZCErr
+		tc.writeZCErr = nil
+	}
+	tc.writePinner.Unpin()
+	clear(tc.writeBuffers)
+	tc.writing = false
+	if e := tc.writeZCHeld; e != nil {
+		// connection is closed, kernel is done with the buffer
+		tc.writeZCHeld = nil
+		tc.release(e)
+		tc.sent(e.sent, e.n, tc.shutdownError)
+		return
+	}
+	if err != nil {
+		tc.shutdown(err)
+		return
+	}
+	tc.written(int(res))
+	tc.flush()
+}
+
+// written consumes n bytes from the queue and calls completion callbacks for
+// all fully written sends. Callbacks are called after all n bytes are
+// consumed, callback can send and flush the queue.
+func (tc *TCPConn) written(n int) {
+	tc.queued -= n
+	if n > 0 {
+		tc.timeouts.lastSend = time.Now()
+		tc.loop.stats.bytesSent.Add(uint64(n))
+	}
+	// written can be called again from the callbacks, take ownership
+	done := tc.doneEntries[:0]
+	tc.doneEntries = nil
+	for len(tc.outq) > 0 {
+		e := tc.outq[0]
+		if e.file != nil && e.file.fd < 0 {
+			break // file not opened yet, length is unknown
 		}
-		consumeBuffers(&buffers, n)
-		if len(buffers) == 0 {
-			pinner.Unpin()
+		rest := e.len - e.n
+		if n < rest {
+			consumeBuffers(&e.buffers, n)
+			e.n += n
+			break
+		}
+		n -= rest
+		e.n = e.len
+		tc.release(e)
+		tc.popOut()
+		done = append(done, e)
+	}
+	for _, e := range done {
+		sent, en := e.sent, e.n
+		tc.freeEntry(e)
+		tc.sent(sent, en, nil)
+	}
+	clear(done)
+	tc.doneEntries = done[:0]
+	tc.checkHighWaterMark()
+}
+
+// failQueued calls completion callbacks for all queued sends with err. Zero
+// copy send in flight is held until the kernel notifies that it is done with
+// the buffer.
+func (tc *TCPConn) failQueued(err error) {
+	outq := tc.outq
+	tc.outq = nil
+	tc.queued = 0
+	if tc.writing && tc.writeZC && len(outq) > 0 {
+		tc.writeZCHeld = outq[0]
+		outq[0] = nil
+		outq = outq[1:]
+	}
+	for _, e := range outq {
+		tc.release(e)
+		tc.sent(e.sent, e.n, err)
+	}
+	clear(outq)
+}
+
+// release unpins entry buffers and closes file opened by SendFilePath
+func (tc *TCPConn) release(e *outEntry) {
+	e.pinner.Unpin()
+	if f := e.file; f != nil && f.owned && f.fd >= 0 {
+		tc.loop.CloseFile(f.fd, nil)
+		f.fd = -1
+	}
+}
+
+// pushOut appends entry to the outbound queue. Queue backing array is reused
+// from the start each time queue gets empty.
+func (tc *TCPConn) pushOut(e *outEntry) {
+	if len(tc.outq) == 0 {
+		tc.outq = tc.outqBuf
+	}
+	tc.outq = append(tc.outq, e)
+	if len(tc.outq) == 1 {
+		tc.outqBuf = tc.outq[:0]
+	}
+}
+
+// popOut removes entry from the head of the outbound queue
+func (tc *TCPConn) popOut() {
+	tc.outq[0] = nil
+	tc.outq = tc.outq[1:]
+}
+
+// maxFreeEntries limits number of sent entries kept for reuse
+const maxFreeEntries = 16
+
+func (tc *TCPConn) newEntry() *outEntry {
+	if n := len(tc.freeEntries); n > 0 {
+		e := tc.freeEntries[n-1]
+		tc.freeEntries[n-1] = nil
+		tc.freeEntries = tc.freeEntries[:n-1]
+		return e
+	}
+	return &outEntry{}
+}
+
+// freeEntry resets released entry and keeps it for reuse
+func (tc *TCPConn) freeEntry(e *outEntry) {
+	if e.file != nil || len(tc.freeEntries) >= maxFreeEntries {
+		return
+	}
+	clear(e.buffers[:cap(e.buffers)])
+	e.buffers = e.buffers[:0]
+	e.len, e.n, e.sent = 0, 0, nil
+	tc.freeEntries = append(tc.freeEntries, e)
+}
+
+// sent calls send completion callback if set, or upstream Sent on success.
+func (tc *TCPConn) sent(cb func(int, error), n int, err error) {
+	if cb == nil {
+		if err == nil {
 			tc.up.Sent()
-			return
 		}
-		// send rest of the data
-		iovecs := buffersToIovec(buffers)
-		pinner.Pin(&iovecs[0])
-		tc.loop.prepareWritev(tc.fd, iovecs, cb)
+		return
 	}
-	iovecs := buffersToIovec(buffers)
-	pinner.Pin(&iovecs[0])
-	tc.loop.prepareWritev(tc.fd, iovecs, cb)
+	cb(n, err)
+}
+
+// outEntry is single send in the outbound queue
+type outEntry struct {
+	buffers [][]byte // not yet written buffers
+	len     int      // total send length
+	n       int      // bytes written so far
+	sent    func(int, error)
+	pinner  runtime.Pinner
+	file    *fileSend // set for SendFile entries
 }
 
-func buffersToIovec(buffers [][]byte) []syscall.Iovec {
-	var iovecs []syscall.Iovec
+// buffersToIovec appends iovec for each non empty buffer to iovecs
+func buffersToIovec(iovecs []syscall.Iovec, buffers [][]byte) []syscall.Iovec {
 	for _, buf := range buffers {
 		if len(buf) == 0 {
 			continue
@@ -130,15 +520,51 @@ func (tc *TCPConn) Close() {
 	tc.shutdown(ErrUpstreamClose)
 }
 
+// CloseWrite shuts down the writing side of the connection after all queued
+// sends are written. Connection continues to receive until peer closes its
+// side, then connection is closed and upstream Closed is called with io.EOF.
+// Any send after CloseWrite fails with ErrWriteClosed.
+func (tc *TCPConn) CloseWrite() {
+	if tc.writeClosed || tc.shutdownError != nil {
+		return
+	}
+	tc.writeClosed = true
+	tc.flush()
+}
+
+func (tc *TCPConn) shutdownWrite() {
+	tc.writeShutdown = true
+	tc.loop.prepareShutdown(tc.fd, tc.fixed, syscall.SHUT_WR, func(res int32, flags uint32, err *ErrErrno) {
+		if err != nil {
+			tc.shutdown(err)
+		}
+	})
+}
+
 // recvLoop starts multishot recv on fd
 // Will receive on fd until error occurs.
 func (tc *TCPConn) recvLoop() {
-	var cb completionCallback
-	cb = func(res int32, flags uint32, err *ErrErrno) {
+	tc.recvCb = func(res int32, flags uint32, err *ErrErrno) {
+		if !isMultiShot(flags) {
+			tc.recvArmed = false
+		}
 		if err != nil {
+			if err.Canceled() && tc.shutdownError == nil {
+				// canceled by PauseRecv
+				if !tc.recvPaused {
+					// resumed before cancel completed
+					tc.armRecv()
+				}
+				return
+			}
 			if err.Temporary() {
 				slog.Debug("tcp conn read temporary error", "error", err.Error())
-				tc.loop.prepareRecv(tc.fd, cb)
+				if err.Errno == syscall.ENOBUFS {
+					tc.loop.stats.noBuffers.Add(1)
+					tc.buffers.exhaust()
+				}
+				tc.loop.stats.recvRestarts.Add(1)
+				tc.armRecv()
 				return
 			}
 			if !err.ConnectionReset() {
@@ -148,21 +574,111 @@ func (tc *TCPConn) recvLoop() {
 			return
 		}
 		if res == 0 {
+			if len(tc.held) > 0 {
+				// deliver held data before close
+				tc.heldEOF = true
+				return
+			}
 			tc.shutdown(io.EOF)
 			return
 		}
-		buf, id := tc.loop.buffers.get(res, flags)
-		tc.up.Received(buf)
-		tc.loop.buffers.release(buf, id)
+		tc.timeouts.lastRecv = time.Now()
+		tc.loop.stats.bytesReceived.Add(uint64(res))
+		buf, id := tc.buffers.get(res, flags)
+		if tc.recvPaused {
+			// received before pause was completed, hold until resume
+			held := make([]byte, len(buf))
+			copy(held, buf)
+			tc.held = append(tc.held, held)
+		} else {
+			tc.up.Received(buf)
+		}
+		tc.buffers.release(buf, id)
 		if !isMultiShot(flags) {
-			slog.Debug("tcp conn multishot terminated", slog.Uint64("flags", uint64(flags)), slog.String("error", err.Error()))
+			slog.Debug("tcp conn multishot terminated", slog.Uint64("flags", uint64(flags)))
+			tc.loop.stats.recvRestarts.Add(1)
 			// io_uring can terminate multishot recv when cqe is full
 			// need to restart it then
 			// ref: https://lore.kernel.org/lkml/20220630091231.1456789-3-dylany@fb.com/T/#re5daa4d5b6e4390ecf024315d9693e5d18d61f10
-			tc.loop.prepareRecv(tc.fd, cb)
+			tc.armRecv()
 		}
 	}
-	tc.loop.prepareRecv(tc.fd, cb)
+	tc.armRecv()
+}
+
+// armRecv prepares multishot recv unless connection is paused or closed
+func (tc *TCPConn) armRecv() {
+	if tc.recvArmed || tc.recvPaused || tc.shutdownError != nil {
+		return
+	}
+	tc.recvArmed = true
+	tc.recvUserData = 0
+	tc.loop.prepare(tc.recvOp)
+}
+
+// prepareRecv prepares provided buffers recv, multishot if kernel supports it
+func (tc *TCPConn) prepareRecv(sqe *giouring.SubmissionQueueEntry) {
+	if tc.recvPaused || tc.shutdownError != nil {
+		// paused while recv was in the loop pending list
+		sqe.PrepareNop()
+		tc.loop.callbacks.set(sqe, func(res int32, flags uint32, err *ErrErrno) {
+			tc.recvArmed = false
+			tc.armRecv()
+		})
+		return
+	}
+	if tc.loop.features.multishotRecv {
+		sqe.PrepareRecvMultishot(tc.fd, 0, 0, 0)
+	} else {
+		sqe.PrepareRecv(tc.fd, 0, 0, 0)
+	}
+	sqe.Flags = giouring.SqeBufferSelect
+	sqe.BufIG = tc.buffers.group
+	useFixed(sqe, tc.fixed)
+	tc.loop.callbacks.set(sqe, tc.recvCb)
+	// used for cancel
+	tc.recvUserData = sqe.UserData
+}
+
+// PauseRecv stops receiving from the connection. Upstream Received is not
+// called until ResumeRecv. Kernel socket buffer fills up and peer is slowed
+// down by tcp flow control.
+func (tc *TCPConn) PauseRecv() {
+	if tc.recvPaused || tc.shutdownError != nil {
+		return
+	}
+	tc.recvPaused = true
+	tc.timeouts.paused = true
+	// not yet prepared recv is dropped in prepareRecv
+	if tc.recvArmed && tc.recvUserData != 0 {
+		tc.loop.prepareCancel(tc.recvUserData, func(res int32, flags uint32, err *ErrErrno) {})
+	}
+}
+
+// ResumeRecv continues receiving after PauseRecv. Data received while pause
+// was in progress is delivered first.
+func (tc *TCPConn) ResumeRecv() {
+	if !tc.recvPaused || tc.shutdownError != nil {
+		return
+	}
+	tc.recvPaused = false
+	tc.timeouts.paused = false
+	tc.timeouts.lastRecv = time.Now()
+	for len(tc.held) > 0 && !tc.recvPaused && tc.shutdownError == nil {
+		buf := tc.held[0]
+		tc.held[0] = nil
+		tc.held = tc.held[1:]
+		tc.up.Received(buf)
+	}
+	if tc.recvPaused || tc.shutdownError != nil {
+		return
+	}
+	if tc.heldEOF {
+		tc.shutdown(io.EOF)
+		return
+	}
+	tc.armRecv()
+	tc.checkTimeouts()
 }
 
 // shutdown tcp (both) then close fd
@@ -174,24 +690,29 @@ func (tc *TCPConn) shutdown(err error) {
 		return
 	}
 	tc.shutdownError = err
-	tc.loop.prepareShutdown(tc.fd, func(res int32, flags uint32, err *ErrErrno) {
-		if err != nil {
-			if !err.ConnectionReset() {
-				slog.Debug("tcp conn shutdown", "fd", tc.fd, "err", err, "res", res, "flags", flags)
-			}
-			if tc.closedCallback != nil {
-				tc.closedCallback()
-			}
-			tc.up.Closed(tc.shutdownError)
-			return
+	tc.stopTimeouts()
+	tc.loop.prepareShutdown(tc.fd, tc.fixed, syscall.SHUT_RDWR, func(res int32, flags uint32, err *ErrErrno) {
+		if err != nil && !err.ConnectionReset() {
+			slog.Debug("tcp conn shutdown", "fd", tc.fd, "err", err, "res", res, "flags", flags)
+		}
+		if tc.fixed >= 0 {
+			tc.loop.prepareCloseFixed(tc.fixed, func(res int32, flags uint32, err *ErrErrno) {
+				if err != nil {
+					slog.Debug("tcp conn close fixed", "fd", tc.fd, "fixed", tc.fixed, "err", err)
+				}
+			})
 		}
+		// close fd even if shutdown fails
 		tc.loop.prepareClose(tc.fd, func(res int32, flags uint32, err *ErrErrno) {
 			if err != nil {
 				slog.Debug("tcp conn close", "fd", tc.fd, "errno", err, "res", res, "flags", flags)
 			}
+			tc.failQueued(tc.shutdownError)
+			tc.closePipe()
 			if tc.closedCallback != nil {
 				tc.closedCallback()
 			}
+			tc.loop.connClosed(tc)
 			tc.up.Closed(tc.shutdownError)
 		})
 	})
@@ -3,20 +3,25 @@ package aio
 import (
 	"log/slog"
 	"net"
+	"os"
 	"syscall"
 	"unsafe"
 
 	_ "unsafe"
-
-	"golang.org/x/sys/unix"
 )
 
 type TCPListener struct {
 	loop        *Loop
 	fd          int
 	port        int
+	unixPath    string // unix domain socket file, removed on close
 	accepted    Accepted
+	bufferGroup uint16
+	domain      int
+	socket      SocketOptions // set on each accepted connection
 	connections map[int]*TCPConn
+	timeouts    Timeouts
+	closing     bool
 }
 
 func (l *TCPListener) accept() {
@@ -24,10 +29,24 @@ func (l *TCPListener) accept() {
 	cb = func(res int32, flags uint32, err *ErrErrno) {
 		if err == nil {
 			fd := int(res)
+			l.loop.stats.accepted.Add(1)
 			// create new tcp connection and bind it with upstream layer
 			tc := newTcpConn(l.loop, func() { delete(l.connections, fd) }, fd)
+			if l.timeouts != (Timeouts{}) {
+				tc.SetTimeouts(l.timeouts)
+			}
+			tc.buffers = l.loop.buffers[l.bufferGroup]
+			if l.socket != (SocketOptions{}) {
+				if err := l.socket.apply(fd, l.domain); err != nil {
+					slog.Debug("listener socket options", "fd", fd, "err", err)
+				}
+			}
 			l.accepted(fd, tc)
 			l.connections[fd] = tc
+			if l.loop.shutdown != nil {
+				// accepted while loop is shutting down
+				l.loop.closeGraceful(tc)
+			}
 			return
 		}
 		if err.Temporary() {
@@ -46,6 +65,10 @@ func (l *TCPListener) Close() {
 }
 
 func (l *TCPListener) close(shutdownConnections bool) {
+	if l.closing {
+		return
+	}
+	l.closing = true
 	l.loop.prepareCancelFd(l.fd, func(res int32, flags uint32, err *ErrErrno) {
 		if err != nil {
 			slog.Debug("listener cancel", "fd", l.fd, "err", err, "res", res, "flags", flags)
@@ -55,10 +78,40 @@ func (l *TCPListener) close(shutdownConnections bool) {
 				conn.shutdown(ErrListenerClose)
 			}
 		}
-		delete(l.loop.listeners, l.fd)
+		l.loop.prepareClose(l.fd, func(res int32, flags uint32, err *ErrErrno) {
+			if err != nil {
+				slog.Debug("listener close", "fd", l.fd, "err", err, "res", res, "flags", flags)
+			}
+			delete(l.loop.listeners, l.fd)
+			l.loop.stats.listeners.Add(-1)
+			if l.unixPath != "" {
+				_ = os.Remove(l.unixPath)
+			}
+		})
 	})
 }
 
+// SetBufferGroup selects provided buffers group for all subsequently accepted
+// connections, see Options.BufferGroups.
+func (l *TCPListener) SetBufferGroup(group uint16) error {
+	if _, err := l.loop.bufferGroup(group); err != nil {
+		return err
+	}
+	l.bufferGroup = group
+	return nil
+}
+
+// SetTimeouts sets timeouts for all subsequently accepted connections.
+func (l *TCPListener) SetTimeouts(t Timeouts) {
+	l.timeouts = t
+}
+
+// Port returns port on which listener is accepting connections. Useful when
+// listening on the system assigned port.
+func (l *TCPListener) Port() int {
+	return l.port
+}
+
 func socket(sa syscall.Sockaddr) (int, error) {
 	domain := syscall.AF_INET
 	switch sa.(type) {
@@ -68,20 +121,28 @@ func socket(sa syscall.Sockaddr) (int, error) {
 	return syscall.Socket(domain, syscall.SOCK_STREAM, 0)
 }
 
-func listen(sa syscall.Sockaddr, domain int) (int, int, error) {
+func listen(sa syscall.Sockaddr, domain int, cfg ListenConfig) (int, int, error) {
 	port := 0
 	fd, err := syscall.Socket(domain, syscall.SOCK_STREAM, 0)
 	if err != nil {
 		return 0, 0, err
 	}
-	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+	fail := func(err error) (int, int, error) {
+		_ = syscall.Close(fd)
 		return 0, 0, err
 	}
-	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
-		return 0, 0, err
+	if domain == syscall.AF_UNIX {
+		if path := unixSocketPath(sa); path != "" {
+			if err := removeStaleUnixSocket(path); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := cfg.apply(fd, domain); err != nil {
+		return fail(err)
 	}
 	if err := syscall.Bind(fd, sa); err != nil {
-		return 0, 0, err
+		return fail(err)
 	}
 	if port == 0 {
 		// get system assigned port
@@ -95,10 +156,14 @@ func listen(sa syscall.Sockaddr, domain int) (int, int, error) {
 		}
 	}
 	if err := syscall.SetNonblock(fd, false); err != nil {
-		return 0, 0, err
+		return fail(err)
 	}
-	if err := syscall.Listen(fd, 128); err != nil {
-		return 0, 0, err
+	backlog := cfg.Backlog
+	if backlog <= 0 {
+		backlog = DefaultListenConfig.Backlog
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		return fail(err)
 	}
 	return fd, port, nil
 }
@@ -113,12 +178,19 @@ func resolveTCPAddr(addr string) (syscall.Sockaddr, int, error) {
 	if err != nil {
 		return nil, 0, err
 	}
-	ip := tcpAddr.IP
-	port := tcpAddr.Port
+	sa, domain := ipSockaddr(tcpAddr.IP, tcpAddr.Port)
+	return sa, domain, nil
+}
+
+func ipSockaddr(ip net.IP, port int) (syscall.Sockaddr, int) {
 	if ip4 := ip.To4(); ip4 != nil {
-		return &syscall.SockaddrInet4{Port: port, Addr: [4]byte(ip4)}, syscall.AF_INET, nil
+		return &syscall.SockaddrInet4{Port: port, Addr: [4]byte(ip4)}, syscall.AF_INET
+	}
+	if ip == nil {
+		// unspecified address ":port"
+		return &syscall.SockaddrInet6{Port: port}, syscall.AF_INET6
 	}
-	return &syscall.SockaddrInet6{Port: port, Addr: [16]byte(ip)}, syscall.AF_INET6, nil
+	return &syscall.SockaddrInet6{Port: port, Addr: [16]byte(ip)}, syscall.AF_INET6
 }
 
 //go:linkname sockaddr syscall.Sockaddr.sockaddr
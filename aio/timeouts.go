@@ -0,0 +1,99 @@
+package aio
+
+import (
+	"fmt"
+	"time"
+)
+
+// Timeouts for the tcp connection. Connection is closed with error wrapping
+// ErrTimeout when any of them expires. Zero value means no timeout.
+type Timeouts struct {
+	// Idle is the maximum time without any data received or sent.
+	Idle time.Duration
+	// Read is the maximum time without any data received.
+	Read time.Duration
+	// Handshake is the maximum time from SetTimeouts until HandshakeDone is
+	// called.
+	Handshake time.Duration
+}
+
+// connTimeouts is timeouts state of the tcp connection
+type connTimeouts struct {
+	Timeouts
+	start         time.Time
+	lastRecv      time.Time
+	lastSend      time.Time
+	handshakeDone bool
+	paused        bool // recv is paused, read timeout is not checked
+	timer         *Timer
+}
+
+// SetTimeouts sets connection timeouts. Handshake timeout starts from now.
+func (tc *TCPConn) SetTimeouts(t Timeouts) {
+	now := time.Now()
+	tc.timeouts.Timeouts = t
+	tc.timeouts.start = now
+	tc.timeouts.lastRecv = now
+	tc.timeouts.lastSend = now
+	tc.checkTimeouts()
+}
+
+// HandshakeDone stops handshake timeout. Upper layer should call it when
+// protocol handshake is completed.
+func (tc *TCPConn) HandshakeDone() {
+	tc.timeouts.handshakeDone = true
+}
+
+// checkTimeouts closes connection if any timeout is expired or rearms timer
+// for the next deadline.
+func (tc *TCPConn) checkTimeouts() {
+	t := &tc.timeouts
+	if tc.shutdownError != nil {
+		return
+	}
+	var next time.Time
+	var reason string
+	deadline := func(d time.Duration, from time.Time, name string) {
+		if d <= 0 {
+			return
+		}
+		at := from.Add(d)
+		if next.IsZero() || at.Before(next) {
+			next = at
+			reason = name
+		}
+	}
+	lastActivity := t.lastRecv
+	if t.lastSend.After(lastActivity) {
+		lastActivity = t.lastSend
+	}
+	deadline(t.Idle, lastActivity, "idle")
+	if !t.paused {
+		deadline(t.Read, t.lastRecv, "read")
+	}
+	if !t.handshakeDone {
+		deadline(t.Handshake, t.start, "handshake")
+	}
+	if next.IsZero() {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		return
+	}
+	wait := time.Until(next)
+	if wait <= 0 {
+		tc.shutdown(fmt.Errorf("%s %w", reason, ErrTimeout))
+		return
+	}
+	if t.timer == nil {
+		t.timer = tc.loop.AfterFunc(wait, tc.checkTimeouts)
+		return
+	}
+	t.timer.Reset(wait)
+}
+
+func (tc *TCPConn) stopTimeouts() {
+	if tc.timeouts.timer != nil {
+		tc.timeouts.timer.Stop()
+	}
+}
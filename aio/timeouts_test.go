@@ -0,0 +1,67 @@
+package aio
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPConnTimeouts(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	var closeErrors []error
+	var handshakeDone bool
+	lsn, err := loop.Listen("127.0.0.1:0", func(fd int, tc *TCPConn) {
+		tc.Bind(&testTimeoutsConn{
+			received: func() {
+				// complete handshake on first received data
+				tc.HandshakeDone()
+				handshakeDone = true
+			},
+			closed: func(err error) { closeErrors = append(closeErrors, err) },
+		})
+	})
+	require.NoError(t, err)
+	lsn.SetTimeouts(Timeouts{Handshake: 20 * time.Millisecond, Read: 50 * time.Millisecond})
+	addr := "127.0.0.1:" + strconv.Itoa(lsn.Port())
+
+	// silent client is closed by handshake timeout
+	silent, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer silent.Close()
+	// client which sends handshake and then stops sending
+	active, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer active.Close()
+	_, err = active.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	start := time.Now()
+	for len(closeErrors) < 2 {
+		require.NoError(t, loop.runOnce())
+	}
+	require.Less(t, time.Since(start), time.Second)
+	require.True(t, handshakeDone)
+	for _, err := range closeErrors {
+		require.ErrorIs(t, err, ErrTimeout)
+	}
+	require.Equal(t, "handshake timeout", closeErrors[0].Error())
+	require.Equal(t, "read timeout", closeErrors[1].Error())
+
+	lsn.Close()
+	require.NoError(t, loop.runUntilDone())
+}
+
+type testTimeoutsConn struct {
+	received func()
+	closed   func(error)
+}
+
+func (c *testTimeoutsConn) Received([]byte)  { c.received() }
+func (c *testTimeoutsConn) Sent()            {}
+func (c *testTimeoutsConn) Closed(err error) { c.closed(err) }
@@ -0,0 +1,116 @@
+package aio
+
+import (
+	"log/slog"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pawelgaczynski/giouring"
+)
+
+// Timer is handle to the function scheduled on the loop by AfterFunc or
+// Ticker. Timer function is always called in the loop goroutine.
+type Timer struct {
+	loop     *Loop
+	fn       func()
+	interval time.Duration // zero for one shot timers
+	seq      uint64        // incremented on each arm, identifies current operation
+	userData uint64        // of the armed timeout operation, zero when not armed
+	stopped  bool
+}
+
+// AfterFunc waits for the duration to elapse and then calls fn in the loop
+// goroutine.
+func (l *Loop) AfterFunc(d time.Duration, fn func()) *Timer {
+	t := &Timer{loop: l, fn: fn}
+	l.timers[t] = struct{}{}
+	t.arm(d)
+	return t
+}
+
+// Ticker calls fn in the loop goroutine every d until stopped.
+func (l *Loop) Ticker(d time.Duration, fn func()) *Timer {
+	if d <= 0 {
+		panic("non-positive interval for Ticker")
+	}
+	t := &Timer{loop: l, fn: fn, interval: d}
+	l.timers[t] = struct{}{}
+	t.arm(d)
+	return t
+}
+
+// Stop prevents the Timer from firing. Returns true if the call stops the
+// timer, false if the timer has already expired or been stopped.
+func (t *Timer) Stop() bool {
+	if t.stopped {
+		return false
+	}
+	t.stopped = true
+	if t.userData != 0 {
+		t.loop.prepareCancel(t.userData, func(res int32, flags uint32, err *ErrErrno) {})
+	}
+	return true
+}
+
+// Reset changes the timer to expire after duration d. For the ticker d becomes
+// new interval. Returns true if the timer had been active.
+func (t *Timer) Reset(d time.Duration) bool {
+	active := t.Stop()
+	t.stopped = false
+	if t.interval > 0 {
+		t.interval = d
+	}
+	t.loop.timers[t] = struct{}{}
+	t.arm(d)
+	return active
+}
+
+func (t *Timer) arm(d time.Duration) {
+	t.seq++
+	seq := t.seq
+	// timespec is read by the kernel on submit, keep it pinned until completion
+	ts := &syscall.Timespec{}
+	*ts = syscall.NsecToTimespec(int64(d))
+	var pinner runtime.Pinner
+	pinner.Pin(ts)
+	t.loop.prepare(func(sqe *giouring.SubmissionQueueEntry) {
+		sqe.PrepareTimeout(ts, 0, 0)
+		// giouring passes address of the pointer argument, fix it here
+		sqe.Addr = uint64(uintptr(unsafe.Pointer(ts)))
+		t.loop.callbacks.set(sqe, func(res int32, flags uint32, err *ErrErrno) {
+			pinner.Unpin()
+			if seq != t.seq {
+				return // stale operation, timer was reset in the meantime
+			}
+			t.userData = 0
+			if err != nil && !err.Timeout() {
+				if !err.Canceled() {
+					slog.Debug("timer", "errno", err, "res", res, "flags", flags)
+				}
+				t.stopped = true
+			}
+			if t.stopped {
+				delete(t.loop.timers, t)
+				return
+			}
+			if t.interval > 0 {
+				t.arm(t.interval)
+			} else {
+				t.stopped = true
+				delete(t.loop.timers, t)
+			}
+			t.fn()
+		})
+		if seq == t.seq {
+			t.userData = sqe.UserData
+		}
+	})
+}
+
+func (l *Loop) stopTimers() {
+	for t := range l.timers {
+		t.Stop()
+	}
+}
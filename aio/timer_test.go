@@ -0,0 +1,66 @@
+package aio
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimerAfterFunc(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	fired := 0
+	start := time.Now()
+	loop.AfterFunc(10*time.Millisecond, func() { fired++ })
+	stopped := loop.AfterFunc(time.Second, func() { fired++ })
+	require.True(t, stopped.Stop())
+	require.False(t, stopped.Stop())
+
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, 1, fired)
+	require.True(t, time.Since(start) >= 10*time.Millisecond)
+	require.True(t, time.Since(start) < time.Second)
+	require.Len(t, loop.timers, 0)
+	runtime.GC() // checks that pinned pointers are unpinned
+}
+
+func TestTimerTicker(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	ticks := 0
+	var tc *Timer
+	tc = loop.Ticker(time.Millisecond, func() {
+		ticks++
+		if ticks == 5 {
+			tc.Stop()
+		}
+	})
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, 5, ticks)
+	require.Len(t, loop.timers, 0)
+}
+
+func TestTimerReset(t *testing.T) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	fired := 0
+	start := time.Now()
+	tm := loop.AfterFunc(time.Second, func() { fired++ })
+	require.True(t, tm.Reset(time.Millisecond))
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, 1, fired)
+	require.True(t, time.Since(start) < time.Second)
+
+	// reset of the expired timer
+	require.False(t, tm.Reset(time.Millisecond))
+	require.NoError(t, loop.runUntilDone())
+	require.Equal(t, 2, fired)
+}
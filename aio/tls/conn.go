@@ -0,0 +1,411 @@
+// Package tls is tls layer between aio.TCPConn and any aio.Upstream.
+//
+// crypto/tls works only with blocking net.Conn so each tls connection runs two
+// goroutines; reader which drives handshake and decrypts received data, and
+// writer which encrypts data sent by upstream. Both of them communicate with
+// the tcp connection through in memory net.Conn. Encrypted data received by
+// the tcp connection is fed to the in memory connection, and encrypted data
+// written by crypto/tls is posted to the loop and sent by the tcp connection.
+// All upstream callbacks are called in the loop goroutine.
+package tls
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ianic/xnet/aio"
+)
+
+const readBufferLen = 16 * 1024
+
+// Conn is tls connection over aio.TCPConn. It is tcp connection upstream and
+// provides Send, SendBuffers and Close methods to its own upstream.
+// Bind, Send, SendBuffers and Close must be called from the loop goroutine.
+type Conn struct {
+	tc   *aio.TCPConn
+	loop *aio.Loop
+	up   aio.Upstream
+	tls  *tls.Conn
+	mc   *memConn
+	wq   writeQueue
+
+	// loop goroutine state
+	state       tls.ConnectionState
+	issued      uint64   // number of tcp sends
+	completed   uint64   // number of completed tcp sends
+	sentMarkers []uint64 // issued value after each upstream send is encrypted
+	closing     bool     // close tcp connection when all sends are completed
+	closed      bool
+	err         error    // tls error, passed to upstream Closed
+	paused      bool     // upstream paused receiving
+	held        [][]byte // decrypted while paused, delivered on resume
+}
+
+// Server returns server side tls connection over tcp connection. Config must
+// have at least one certificate or set GetCertificate. GetCertificate can be
+// used to select certificate by SNI. Set NextProtos for ALPN.
+func Server(tc *aio.TCPConn, config *tls.Config) *Conn {
+	c := newConn(tc)
+	c.tls = tls.Server(c.mc, config)
+	return c
+}
+
+// Client returns client side tls connection over tcp connection. Config must
+// have ServerName set, or InsecureSkipVerify.
+func Client(tc *aio.TCPConn, config *tls.Config) *Conn {
+	c := newConn(tc)
+	c.tls = tls.Client(c.mc, config)
+	return c
+}
+
+func newConn(tc *aio.TCPConn) *Conn {
+	c := &Conn{tc: tc, loop: tc.Loop()}
+	c.mc = &memConn{c: c}
+	c.mc.cond = sync.NewCond(&c.mc.mu)
+	c.wq.cond = sync.NewCond(&c.wq.mu)
+	return c
+}
+
+// Bind sets upstream and starts tls handshake. Upstream can be changed by
+// calling Bind again.
+func (c *Conn) Bind(up aio.Upstream) {
+	start := c.up == nil
+	c.up = up
+	if start {
+		c.tc.Bind(c)
+		go c.readLoop()
+		go c.writeLoop()
+	}
+}
+
+// ConnectionState returns basic tls details about the connection. Valid after
+// the handshake is completed, that is before first Received call.
+func (c *Conn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+// Send encrypts and sends data. Upstream Sent is called when data is sent.
+func (c *Conn) Send(data []byte) {
+	if c.closing || c.closed {
+		return
+	}
+	c.wq.push(data)
+}
+
+// SendBuffers sends all buffers as single tls write. Upstream Sent is called
+// once when all buffers are sent.
+func (c *Conn) SendBuffers(buffers [][]byte) {
+	var data []byte
+	for _, buf := range buffers {
+		data = append(data, buf...)
+	}
+	c.Send(data)
+}
+
+// PauseRecv stops receiving from the tcp connection. Upstream Received is not
+// called until ResumeRecv, data already decrypted is held until then.
+func (c *Conn) PauseRecv() {
+	if c.paused || c.closed {
+		return
+	}
+	c.paused = true
+	c.tc.PauseRecv()
+}
+
+// ResumeRecv continues receiving after PauseRecv. Held data is delivered
+// first.
+func (c *Conn) ResumeRecv() {
+	if !c.paused || c.closed {
+		return
+	}
+	c.paused = false
+	for len(c.held) > 0 && !c.paused && !c.closed {
+		buf := c.held[0]
+		c.held[0] = nil
+		c.held = c.held[1:]
+		c.up.Received(buf)
+	}
+	if !c.paused && !c.closed {
+		c.tc.ResumeRecv()
+	}
+}
+
+// Close sends tls close notify and closes tcp connection.
+func (c *Conn) Close() {
+	if c.closing || c.closed {
+		return
+	}
+	c.wq.close()
+}
+
+// #region aio.Upstream interface, called by tcp connection
+
+func (c *Conn) Received(buf []byte) {
+	c.mc.feed(buf)
+}
+
+func (c *Conn) Sent() {
+	c.completed++
+	c.drainSentMarkers()
+	c.closeIfFlushed()
+}
+
+func (c *Conn) Closed(err error) {
+	c.closed = true
+	c.held = nil
+	c.mc.closeRead(err)
+	c.wq.close()
+	if c.err != nil {
+		err = c.err
+	}
+	c.up.Closed(err)
+}
+
+// #endregion
+
+// markSent is called in the loop goroutine after all encrypted data of the
+// upstream send is posted. Tcp sends may be already completed.
+func (c *Conn) markSent() {
+	c.sentMarkers = append(c.sentMarkers, c.issued)
+	c.drainSentMarkers()
+}
+
+// drainSentMarkers calls upstream Sent for each upstream send whose tcp sends
+// are completed.
+func (c *Conn) drainSentMarkers() {
+	for len(c.sentMarkers) > 0 && c.completed >= c.sentMarkers[0] {
+		c.sentMarkers = c.sentMarkers[1:]
+		c.up.Sent()
+	}
+}
+
+// closeIfFlushed closes tcp connection when tls connection is closing and
+// all encrypted data is sent.
+func (c *Conn) closeIfFlushed() {
+	if c.closing && !c.closed && c.completed == c.issued {
+		c.tc.Close()
+	}
+}
+
+// send is called in the loop goroutine with data encrypted by crypto/tls
+func (c *Conn) send(data []byte) {
+	if c.closed {
+		return
+	}
+	c.issued++
+	c.tc.Send(data)
+}
+
+// readLoop runs in its own goroutine. Performs handshake and decrypts data.
+// Decrypted data is posted to the loop goroutine.
+func (c *Conn) readLoop() {
+	if err := c.tls.Handshake(); err != nil {
+		slog.Debug("tls handshake", "error", err)
+		c.loop.Post(func() { c.fail(err) })
+		return
+	}
+	state := c.tls.ConnectionState()
+	c.loop.Post(func() { c.state = state })
+	for {
+		buf := make([]byte, readBufferLen)
+		n, err := c.tls.Read(buf)
+		if n > 0 {
+			c.loop.Post(func() { c.received(buf[:n]) })
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				slog.Debug("tls read", "error", err)
+				c.loop.Post(func() { c.fail(err) })
+				return
+			}
+			c.loop.Post(func() { c.startClose() })
+			return
+		}
+	}
+}
+
+// writeLoop runs in its own goroutine. Encrypts data sent by upstream.
+func (c *Conn) writeLoop() {
+	for {
+		data, ok := c.wq.pop()
+		if !ok {
+			break
+		}
+		if _, err := c.tls.Write(data); err != nil {
+			slog.Debug("tls write", "error", err)
+			break
+		}
+		// all encrypted data for this write is already posted to the loop,
+		// mark position after which upstream Sent can be called
+		c.loop.Post(c.markSent)
+	}
+	// sends close notify alert and closes underlying memConn
+	_ = c.tls.Close()
+}
+
+// received is called in the loop goroutine with decrypted data
+func (c *Conn) received(buf []byte) {
+	if c.closed {
+		return
+	}
+	if c.paused {
+		c.held = append(c.held, buf)
+		return
+	}
+	c.up.Received(buf)
+}
+
+// fail closes connection because of the tls error. Error is passed to the
+// upstream Closed instead of the tcp connection close reason.
+func (c *Conn) fail(err error) {
+	if c.closed {
+		return
+	}
+	if c.err == nil {
+		c.err = err
+	}
+	c.startClose()
+}
+
+// startClose stops writer which will send close notify and close tcp
+// connection when all is sent.
+func (c *Conn) startClose() {
+	c.wq.close()
+}
+
+// #region writeQueue
+
+// writeQueue is unbounded queue of upstream sends between loop and writer
+// goroutine. Loop must never block on write.
+type writeQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  [][]byte
+	closed bool
+}
+
+func (q *writeQueue) push(data []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, data)
+	q.cond.Signal()
+}
+
+func (q *writeQueue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	data := q.items[0]
+	q.items = q.items[1:]
+	return data, true
+}
+
+func (q *writeQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Signal()
+}
+
+// #endregion
+
+// #region memConn
+
+// memConn is in memory net.Conn used by crypto/tls. Read blocks until tcp
+// connection receives data. Write posts data to the loop goroutine where it
+// is sent by the tcp connection.
+type memConn struct {
+	c       *Conn
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	readErr error
+	closed  bool
+}
+
+// feed is called from the loop goroutine with received data.
+func (m *memConn) feed(buf []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = append(m.pending, buf...)
+	m.cond.Signal()
+}
+
+// closeRead is called from the loop goroutine when tcp connection is closed.
+func (m *memConn) closeRead(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readErr == nil {
+		m.readErr = err
+	}
+	m.cond.Signal()
+}
+
+func (m *memConn) Read(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.pending) == 0 && m.readErr == nil && !m.closed {
+		m.cond.Wait()
+	}
+	if len(m.pending) > 0 {
+		n := copy(p, m.pending)
+		m.pending = m.pending[n:]
+		return n, nil
+	}
+	if m.closed {
+		return 0, net.ErrClosed
+	}
+	return 0, m.readErr
+}
+
+func (m *memConn) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	closed := m.closed
+	m.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	m.c.loop.Post(func() { m.c.send(data) })
+	return len(p), nil
+}
+
+// Close is called by crypto/tls after close notify is written.
+func (m *memConn) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	m.cond.Broadcast()
+	m.c.loop.Post(func() {
+		m.c.closing = true
+		m.c.closeIfFlushed()
+	})
+	return nil
+}
+
+func (m *memConn) LocalAddr() net.Addr                { return memAddr{} }
+func (m *memConn) RemoteAddr() net.Addr               { return memAddr{} }
+func (m *memConn) SetDeadline(t time.Time) error      { return nil }
+func (m *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type memAddr struct{}
+
+func (memAddr) Network() string { return "aio" }
+func (memAddr) String() string  { return "aio" }
+
+// #endregion
@@ -0,0 +1,324 @@
+package tls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ianic/xnet/aio"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	cert, pool := testCertificate(t)
+	loop, err := aio.New(aio.DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"aio"},
+	}
+	protocol := make(chan string, 1)
+	lsn, err := loop.Listen("127.0.0.1:0", func(fd int, tc *aio.TCPConn) {
+		c := Server(tc, serverConfig)
+		c.Bind(&testEchoConn{c: c, protocol: protocol})
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	loopDone := make(chan struct{})
+	go func() {
+		require.NoError(t, loop.Run(ctx))
+		close(loopDone)
+	}()
+
+	conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(lsn.Port())), &tls.Config{
+		RootCAs:    pool,
+		ServerName: "localhost",
+		NextProtos: []string{"aio"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "aio", conn.ConnectionState().NegotiatedProtocol)
+
+	data := make([]byte, 64*1024)
+	_, _ = rand.Read(data)
+	go func() {
+		_, err := conn.Write(data)
+		require.NoError(t, err)
+	}()
+	rsp := make([]byte, len(data))
+	_, err = io.ReadFull(conn, rsp)
+	require.NoError(t, err)
+	require.Equal(t, data, rsp)
+	require.Equal(t, "aio", <-protocol)
+	require.NoError(t, conn.Close())
+
+	cancel()
+	<-loopDone
+}
+
+func TestClient(t *testing.T) {
+	cert, pool := testCertificate(t)
+	// std lib tls echo server
+	lsn, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	defer lsn.Close()
+	go func() {
+		conn, err := lsn.Accept()
+		require.NoError(t, err)
+		_, _ = io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	loop, err := aio.New(aio.DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	data := []byte("hello over tls")
+	up := &testClientConn{expected: len(data)}
+	require.NoError(t, loop.Dial(lsn.Addr().String(), func(fd int, tc *aio.TCPConn, err error) {
+		require.NoError(t, err)
+		up.c = Client(tc, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+		up.c.Bind(up)
+		up.c.Send(data)
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	up.cancel = cancel
+	require.NoError(t, loop.Run(ctx))
+
+	require.Equal(t, data, up.received)
+	require.Equal(t, 1, up.sent)
+	require.True(t, up.closed)
+}
+
+func TestHandshakeError(t *testing.T) {
+	cert, _ := testCertificate(t)
+	lsn, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	defer lsn.Close()
+	go func() {
+		conn, err := lsn.Accept()
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+
+	loop, err := aio.New(aio.DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	// certificate is not trusted by the client
+	up := &testClientConn{}
+	require.NoError(t, loop.Dial(lsn.Addr().String(), func(fd int, tc *aio.TCPConn, err error) {
+		require.NoError(t, err)
+		up.c = Client(tc, &tls.Config{ServerName: "localhost"})
+		up.c.Bind(up)
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	up.cancel = cancel
+	require.NoError(t, loop.Run(ctx))
+
+	require.True(t, up.closed)
+	var verifyErr *tls.CertificateVerificationError
+	require.ErrorAs(t, up.err, &verifyErr)
+}
+
+func TestPauseRecv(t *testing.T) {
+	cert, pool := testCertificate(t)
+	loop, err := aio.New(aio.DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	lsn, err := loop.Listen("127.0.0.1:0", func(fd int, tc *aio.TCPConn) {
+		c := Server(tc, &tls.Config{Certificates: []tls.Certificate{cert}})
+		c.Bind(&testPauseConn{t: t, c: c})
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	loopDone := make(chan struct{})
+	go func() {
+		require.NoError(t, loop.Run(ctx))
+		close(loopDone)
+	}()
+
+	conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(lsn.Port())), &tls.Config{
+		RootCAs:    pool,
+		ServerName: "localhost",
+	})
+	require.NoError(t, err)
+	data := make([]byte, 256*1024)
+	_, _ = rand.Read(data)
+	go func() {
+		_, err := conn.Write(data)
+		require.NoError(t, err)
+	}()
+	rsp := make([]byte, len(data))
+	_, err = io.ReadFull(conn, rsp)
+	require.NoError(t, err)
+	require.Equal(t, data, rsp)
+	require.NoError(t, conn.Close())
+
+	cancel()
+	<-loopDone
+}
+
+// testPauseConn echoes received data, pauses receiving after each receive and
+// resumes after a while
+func TestSentSingleSend(t *testing.T) {
+	cert, pool := testCertificate(t)
+	loop, err := aio.New(aio.DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	sent := make(chan struct{})
+	lsn, err := loop.Listen("127.0.0.1:0", func(fd int, tc *aio.TCPConn) {
+		c := Server(tc, &tls.Config{Certificates: []tls.Certificate{cert}})
+		c.Bind(&testSentConn{c: c, sent: sent})
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	loopDone := make(chan struct{})
+	go func() {
+		require.NoError(t, loop.Run(ctx))
+		close(loopDone)
+	}()
+
+	conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(lsn.Port())), &tls.Config{
+		RootCAs:    pool,
+		ServerName: "localhost",
+	})
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	rsp := make([]byte, 4)
+	_, err = io.ReadFull(conn, rsp)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(rsp))
+
+	// no more traffic, upstream Sent must not wait for the next send
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("upstream Sent not called")
+	}
+	require.NoError(t, conn.Close())
+	cancel()
+	<-loopDone
+}
+
+func TestSentMarkerAfterCompletion(t *testing.T) {
+	// tcp sends are completed before the marker is posted
+	up := &testClientConn{}
+	c := &Conn{up: up}
+	c.issued = 2
+	c.Sent()
+	c.Sent()
+	require.Equal(t, 0, up.sent)
+	c.markSent()
+	require.Equal(t, 1, up.sent)
+	require.Empty(t, c.sentMarkers)
+}
+
+type testSentConn struct {
+	c    *Conn
+	sent chan struct{}
+}
+
+func (s *testSentConn) Received(buf []byte) { s.c.Send([]byte("pong")) }
+func (s *testSentConn) Sent()               { close(s.sent) }
+func (s *testSentConn) Closed(error)        {}
+
+type testPauseConn struct {
+	t      *testing.T
+	c      *Conn
+	paused bool
+}
+
+func (p *testPauseConn) Received(buf []byte) {
+	require.False(p.t, p.paused)
+	p.c.Send(append([]byte(nil), buf...))
+	p.paused = true
+	p.c.PauseRecv()
+	p.c.loop.AfterFunc(time.Millisecond, func() {
+		p.paused = false
+		p.c.ResumeRecv()
+	})
+}
+func (p *testPauseConn) Sent()        {}
+func (p *testPauseConn) Closed(error) {}
+
+type testEchoConn struct {
+	c        *Conn
+	protocol chan string
+}
+
+func (e *testEchoConn) Received(buf []byte) {
+	if e.protocol != nil {
+		e.protocol <- e.c.ConnectionState().NegotiatedProtocol
+		e.protocol = nil
+	}
+	e.c.Send(buf)
+}
+func (e *testEchoConn) Sent()        {}
+func (e *testEchoConn) Closed(error) {}
+
+type testClientConn struct {
+	c        *Conn
+	expected int
+	received []byte
+	sent     int
+	closed   bool
+	err      error
+	cancel   func()
+}
+
+func (c *testClientConn) Received(buf []byte) {
+	c.received = append(c.received, buf...)
+	if len(c.received) == c.expected {
+		c.c.Close()
+	}
+}
+func (c *testClientConn) Sent() { c.sent++ }
+func (c *testClientConn) Closed(err error) {
+	c.closed = true
+	c.err = err
+	c.cancel()
+}
+
+// testCertificate creates self signed certificate for localhost
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
@@ -0,0 +1,286 @@
+package aio
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/pawelgaczynski/giouring"
+)
+
+// upper layer's events handler interface for datagram connections
+type UDPUpstream interface {
+	// Received is called for each datagram with the peer address.
+	Received(data []byte, from netip.AddrPort)
+	// Sent is called when Send or SendTo is completed. Errors are not fatal
+	// for the udp connection.
+	Sent(error)
+	Closed(error)
+}
+
+type UDPConn struct {
+	loop      *Loop
+	fd        int
+	up        UDPUpstream
+	msg       syscall.Msghdr                    // recvmsg header
+	name      [syscall.SizeofSockaddrInet6]byte // peer address of the single-shot recvmsg
+	pinner    runtime.Pinner
+	closeErr  error
+	connected bool // dialed, can use Send without address
+}
+
+// ListenUDP binds udp socket to the addr and starts receiving datagrams.
+// ip4:  "127.0.0.1:8080",
+// ip6: "[::1]:80"
+func (l *Loop) ListenUDP(addr string, up UDPUpstream) (*UDPConn, error) {
+	sa, domain, err := resolveUDPAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(domain, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	return l.newUDPConn(fd, up, false), nil
+}
+
+// DialUDP creates udp socket connected to the addr. Only datagrams from the
+// addr are received.
+func (l *Loop) DialUDP(addr string, up UDPUpstream) (*UDPConn, error) {
+	sa, domain, err := resolveUDPAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(domain, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	// connect on udp socket only sets default destination, it doesn't block
+	if err := syscall.Connect(fd, sa); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	return l.newUDPConn(fd, up, true), nil
+}
+
+func (l *Loop) newUDPConn(fd int, up UDPUpstream, connected bool) *UDPConn {
+	uc := &UDPConn{loop: l, fd: fd, up: up, connected: connected}
+	if !l.features.multishotRecv {
+		// single-shot recvmsg writes peer address to the msg name
+		uc.msg.Name = &uc.name[0]
+	}
+	uc.pinner.Pin(&uc.msg)
+	l.udpConns[fd] = uc
+	uc.recvLoop()
+	return uc
+}
+
+// LocalAddr returns local address of the socket.
+func (uc *UDPConn) LocalAddr() netip.AddrPort {
+	sa, err := syscall.Getsockname(uc.fd)
+	if err != nil {
+		return netip.AddrPort{}
+	}
+	return sockaddrToAddrPort(sa)
+}
+
+// Send sends datagram to the dialed address.
+func (uc *UDPConn) Send(data []byte) {
+	if !uc.connected {
+		uc.up.Sent(&net.AddrError{Err: "missing destination address"})
+		return
+	}
+	uc.send(data, nil)
+}
+
+// SendTo sends datagram to the addr.
+func (uc *UDPConn) SendTo(data []byte, addr netip.AddrPort) {
+	uc.send(data, addrPortToSockaddr(addr))
+}
+
+func (uc *UDPConn) send(data []byte, sa syscall.Sockaddr) {
+	if uc.closeErr != nil {
+		uc.up.Sent(uc.closeErr)
+		return
+	}
+	var pinner runtime.Pinner
+	msg := &syscall.Msghdr{}
+	if sa != nil {
+		rawAddr, rawAddrLen, err := sockaddr(sa)
+		if err != nil {
+			uc.up.Sent(err)
+			return
+		}
+		pinner.Pin(rawAddr)
+		msg.Name = (*byte)(rawAddr)
+		msg.Namelen = rawAddrLen
+	}
+	if len(data) > 0 {
+		pinner.Pin(&data[0])
+		iov := &syscall.Iovec{Base: &data[0]}
+		iov.SetLen(len(data))
+		pinner.Pin(iov)
+		msg.Iov = iov
+		msg.Iovlen = 1
+	}
+	pinner.Pin(msg)
+	uc.loop.prepareSendMsg(uc.fd, msg, func(res int32, flags uint32, err *ErrErrno) {
+		pinner.Unpin()
+		if err != nil {
+			uc.up.Sent(err)
+			return
+		}
+		uc.loop.stats.bytesSent.Add(uint64(res))
+		uc.up.Sent(nil)
+	})
+}
+
+// recvLoop starts multishot recvmsg on fd
+func (uc *UDPConn) recvLoop() {
+	var cb completionCallback
+	cb = func(res int32, flags uint32, err *ErrErrno) {
+		if err != nil {
+			if uc.closeErr != nil {
+				return
+			}
+			if err.Temporary() || err.Errno == syscall.ECONNREFUSED {
+				slog.Debug("udp conn read temporary error", "error", err.Error())
+				if err.Errno == syscall.ENOBUFS {
+					uc.loop.stats.noBuffers.Add(1)
+					uc.buffers().exhaust()
+				}
+				uc.loop.stats.recvRestarts.Add(1)
+				uc.recv(cb)
+				return
+			}
+			slog.Warn("udp conn read error", "error", err.Error())
+			uc.close(err)
+			return
+		}
+		buf, id := uc.buffers().get(res, flags)
+		data, from := uc.parse(buf)
+		uc.loop.stats.bytesReceived.Add(uint64(len(data)))
+		uc.up.Received(data, from)
+		uc.buffers().release(buf, id)
+		if !isMultiShot(flags) && uc.closeErr == nil {
+			uc.loop.stats.recvRestarts.Add(1)
+			uc.recv(cb)
+		}
+	}
+	uc.recv(cb)
+}
+
+// recv prepares provided buffer recvmsg
+func (uc *UDPConn) recv(cb completionCallback) {
+	// Multishot recvmsg uses namelen as size of the room for the peer
+	// address in the provided buffer. Single-shot sets it to the size of
+	// the received address, reset it for the next recvmsg.
+	uc.msg.Namelen = syscall.SizeofSockaddrInet6
+	uc.loop.prepareRecvMsg(uc.fd, &uc.msg, defaultBufferGroup, cb)
+}
+
+// buffers returns provided buffers group used for receiving
+func (uc *UDPConn) buffers() *providedBuffers {
+	return uc.loop.buffers[defaultBufferGroup]
+}
+
+// parse splits provided buffer filled by recvmsg into payload and peer
+// address. Multishot recvmsg buffer starts with io_uring_recvmsg_out header
+// followed by name, control and payload. Single-shot buffer is payload only,
+// peer address is in the msg name.
+func (uc *UDPConn) parse(buf []byte) ([]byte, netip.AddrPort) {
+	if !uc.loop.features.multishotRecv {
+		if uc.msg.Flags&syscall.MSG_TRUNC > 0 {
+			slog.Debug("udp conn datagram truncated", "len", len(buf))
+		}
+		return buf, rawToAddrPort(uc.name[:uc.msg.Namelen])
+	}
+	hdr := (*giouring.RecvmsgOut)(unsafe.Pointer(&buf[0]))
+	if hdr.Flags&syscall.MSG_TRUNC > 0 {
+		slog.Debug("udp conn datagram truncated", "len", hdr.PayloadLen)
+	}
+	start := int(unsafe.Sizeof(*hdr))
+	name := buf[start : start+int(uc.msg.Namelen)]
+	start += int(uc.msg.Namelen) + int(uc.msg.Controllen)
+	return buf[start:], rawToAddrPort(name[:hdr.Namelen])
+}
+
+// Close stops receiving and closes socket. Upstream Closed is called when
+// done.
+func (uc *UDPConn) Close() {
+	uc.close(ErrUpstreamClose)
+}
+
+func (uc *UDPConn) close(reason error) {
+	if uc.closeErr != nil {
+		return
+	}
+	uc.closeErr = reason
+	uc.loop.prepareCancelFd(uc.fd, func(res int32, flags uint32, err *ErrErrno) {
+		uc.loop.prepareClose(uc.fd, func(res int32, flags uint32, err *ErrErrno) {
+			if err != nil {
+				slog.Debug("udp conn close", "fd", uc.fd, "errno", err, "res", res, "flags", flags)
+			}
+			uc.pinner.Unpin()
+			delete(uc.loop.udpConns, uc.fd)
+			uc.up.Closed(uc.closeErr)
+		})
+	})
+}
+
+// resolveUDPAddr converts string address to syscall.Sockaddr
+func resolveUDPAddr(addr string) (syscall.Sockaddr, int, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	sa, domain := ipSockaddr(udpAddr.IP, udpAddr.Port)
+	return sa, domain, nil
+}
+
+func addrPortToSockaddr(addr netip.AddrPort) syscall.Sockaddr {
+	ip := addr.Addr()
+	if ip.Is4() || ip.Is4In6() {
+		return &syscall.SockaddrInet4{Port: int(addr.Port()), Addr: ip.Unmap().As4()}
+	}
+	return &syscall.SockaddrInet6{Port: int(addr.Port()), Addr: ip.As16()}
+}
+
+func sockaddrToAddrPort(sa syscall.Sockaddr) netip.AddrPort {
+	switch v := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return netip.AddrPortFrom(netip.AddrFrom4(v.Addr), uint16(v.Port))
+	case *syscall.SockaddrInet6:
+		return netip.AddrPortFrom(netip.AddrFrom16(v.Addr), uint16(v.Port))
+	}
+	return netip.AddrPort{}
+}
+
+// rawToAddrPort converts raw sockaddr_in or sockaddr_in6 bytes
+func rawToAddrPort(raw []byte) netip.AddrPort {
+	if len(raw) < 2 {
+		return netip.AddrPort{}
+	}
+	// family is in host byte order, port in network
+	switch *(*uint16)(unsafe.Pointer(&raw[0])) {
+	case syscall.AF_INET:
+		if len(raw) >= syscall.SizeofSockaddrInet4 {
+			port := binary.BigEndian.Uint16(raw[2:4])
+			return netip.AddrPortFrom(netip.AddrFrom4([4]byte(raw[4:8])), port)
+		}
+	case syscall.AF_INET6:
+		if len(raw) >= syscall.SizeofSockaddrInet6 {
+			port := binary.BigEndian.Uint16(raw[2:4])
+			return netip.AddrPortFrom(netip.AddrFrom16([16]byte(raw[8:24])), port)
+		}
+	}
+	return netip.AddrPort{}
+}
@@ -0,0 +1,83 @@
+package aio
+
+import (
+	"net/netip"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPConn(t *testing.T) {
+	loop, err := New(Options{
+		RingEntries:      16,
+		RecvBuffersCount: 8,
+		RecvBufferLen:    1024,
+	})
+	require.NoError(t, err)
+	defer loop.Close()
+
+	// server echoes datagrams back to the sender
+	server := &testUDPConn{}
+	server.uc, err = loop.ListenUDP("127.0.0.1:0", server)
+	require.NoError(t, err)
+	server.echo = true
+	addr := server.uc.LocalAddr()
+	require.True(t, addr.Port() > 0)
+
+	client := &testUDPConn{}
+	client.uc, err = loop.DialUDP(addr.String(), client)
+	require.NoError(t, err)
+	client.onReceived = func() {
+		if len(client.received) == 3 {
+			client.uc.Close()
+			server.uc.Close()
+		}
+	}
+
+	clientAddr := client.uc.LocalAddr()
+	data := [][]byte{[]byte("foo"), []byte("bar"), testRandomBuf(t, 512)}
+	for _, d := range data {
+		client.uc.Send(d)
+	}
+	require.NoError(t, loop.runUntilDone())
+	runtime.GC()
+
+	require.Equal(t, data, client.received)
+	require.Equal(t, data, server.received)
+	require.Equal(t, clientAddr, server.from)
+	require.Equal(t, 3, client.sent)
+	require.Equal(t, 3, server.sent)
+	require.True(t, client.closed)
+	require.True(t, server.closed)
+	require.Len(t, loop.udpConns, 0)
+}
+
+type testUDPConn struct {
+	uc         *UDPConn
+	echo       bool
+	received   [][]byte
+	from       netip.AddrPort
+	sent       int
+	closed     bool
+	onReceived func()
+}
+
+func (c *testUDPConn) Received(data []byte, from netip.AddrPort) {
+	c.received = append(c.received, toOwn(data))
+	c.from = from
+	if c.echo {
+		c.uc.SendTo(toOwn(data), from)
+	}
+	if c.onReceived != nil {
+		c.onReceived()
+	}
+}
+
+func (c *testUDPConn) Sent(err error) {
+	if err == nil {
+		c.sent++
+	}
+}
+
+func (c *testUDPConn) Closed(error) { c.closed = true }
@@ -0,0 +1,76 @@
+package aio
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const unixAddrPrefix = "unix:"
+
+// resolveAddr converts string address to syscall.Sockaddr. Supports tcp
+// addresses and unix domain socket addresses with "unix:" prefix.
+// "unix:/run/app.sock"
+// "unix:@abstract"
+func resolveAddr(addr string) (syscall.Sockaddr, int, error) {
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		return resolveUnixAddr(addr)
+	}
+	return resolveTCPAddr(addr)
+}
+
+// resolveUnixAddr converts "unix:" prefixed address. Name starting with @ is
+// in the abstract namespace.
+func resolveUnixAddr(addr string) (syscall.Sockaddr, int, error) {
+	name := strings.TrimPrefix(addr, unixAddrPrefix)
+	if name == "" || name == "@" {
+		return nil, 0, &os.PathError{Op: "resolve", Path: addr, Err: syscall.EINVAL}
+	}
+	return &syscall.SockaddrUnix{Name: name}, syscall.AF_UNIX, nil
+}
+
+// unixSocketPath returns file system path of the unix socket address or empty
+// string for abstract and non unix addresses.
+func unixSocketPath(sa syscall.Sockaddr) string {
+	if su, ok := sa.(*syscall.SockaddrUnix); ok && !strings.HasPrefix(su.Name, "@") {
+		return su.Name
+	}
+	return ""
+}
+
+// removeStaleUnixSocket removes socket file left by the process which didn't
+// clean up. File is removed only if nobody is listening on it.
+func removeStaleUnixSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return &os.PathError{Op: "listen", Path: path, Err: syscall.EADDRINUSE}
+	}
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	err = syscall.Connect(fd, &syscall.SockaddrUnix{Name: path})
+	if err == nil {
+		return &os.PathError{Op: "listen", Path: path, Err: syscall.EADDRINUSE}
+	}
+	if err != syscall.ECONNREFUSED {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// PeerCred returns credentials of the peer process for the unix domain socket
+// connection. Credentials are the ones in effect at the time of the connect.
+func (tc *TCPConn) PeerCred() (*unix.Ucred, error) {
+	return unix.GetsockoptUcred(tc.fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+}
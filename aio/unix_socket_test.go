@@ -0,0 +1,72 @@
+package aio
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveUnixAddr(t *testing.T) {
+	sa, domain, err := resolveAddr("unix:/run/app.sock")
+	require.NoError(t, err)
+	require.Equal(t, syscall.AF_UNIX, domain)
+	require.Equal(t, "/run/app.sock", sa.(*syscall.SockaddrUnix).Name)
+	require.Equal(t, "/run/app.sock", unixSocketPath(sa))
+
+	sa, _, err = resolveAddr("unix:@app")
+	require.NoError(t, err)
+	require.Equal(t, "", unixSocketPath(sa))
+
+	_, _, err = resolveAddr("unix:")
+	require.Error(t, err)
+}
+
+func TestUnixSocketListenDial(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	// leave stale socket file
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	require.NoError(t, syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}))
+	require.NoError(t, syscall.Close(fd))
+
+	for _, addr := range []string{"unix:" + path, "unix:@aio-test-" + t.Name()} {
+		testUnixSocketListenDial(t, addr)
+	}
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func testUnixSocketListenDial(t *testing.T, addr string) {
+	loop, err := New(DefaultOptions)
+	require.NoError(t, err)
+	defer loop.Close()
+
+	server := testConn{}
+	lsn, err := loop.Listen(addr, func(fd int, tc *TCPConn) {
+		cred, err := tc.PeerCred()
+		require.NoError(t, err)
+		require.Equal(t, int32(os.Getpid()), cred.Pid)
+		tc.Bind(&server)
+	})
+	require.NoError(t, err)
+
+	data := testRandomBuf(t, 1024)
+	client := &testCloserConn{}
+	require.NoError(t, loop.Dial(addr, func(fd int, tc *TCPConn, err error) {
+		require.NoError(t, err)
+		client.tc = tc
+		tc.Bind(client)
+		tc.Send(data)
+	}))
+	for !server.closed {
+		require.NoError(t, loop.runOnce())
+	}
+	require.True(t, client.closed)
+	testRequireEqualBuffers(t, data, server.received)
+
+	lsn.Close()
+	require.NoError(t, loop.runUntilDone())
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"log/slog"
+	"time"
 
 	"github.com/ianic/xnet/aio"
 	"github.com/ianic/xnet/aio/signal"
@@ -43,10 +44,12 @@ func run(ipPort string) error {
 	}
 
 	// start tcp listener
-	_, err = loop.Listen(ipPort, tcpAccepted)
+	lsn, err := loop.Listen(ipPort, tcpAccepted)
 	if err != nil {
 		return err
 	}
+	// close connections which don't complete ws handshake in time
+	lsn.SetTimeouts(aio.Timeouts{Handshake: 10 * time.Second})
 	// run loop, this is blocking
 	if err := loop.Run(signal.InterruptContext()); err != nil {
 		slog.Error("run", "error", err)
@@ -69,6 +72,7 @@ func (h *handshake) Received(data []byte) {
 		h.tcpConn.Close()
 		return
 	}
+	h.tcpConn.HandshakeDone()
 	h.wsAccepted(h.fd, h.tcpConn, hs.NewAsyncConn(h.tcpConn))
 	h.tcpConn.Send([]byte(hs.Response()))
 }
@@ -12,6 +12,12 @@ type TcpConn interface {
 	Close()
 }
 
+// optional lower layer flow control, implemented by aio.TCPConn
+type recvPauser interface {
+	PauseRecv()
+	ResumeRecv()
+}
+
 // upper layer's events handler interface
 type Upstream interface {
 	Received([]byte)
@@ -148,6 +154,21 @@ func (c *AsyncConn) Close() {
 	c.tc.Close()
 }
 
+// PauseRecv stops receiving from the tcp connection, if supported. Use it
+// when upstream can't keep up, peer will be slowed down by tcp flow control.
+func (c *AsyncConn) PauseRecv() {
+	if p, ok := c.tc.(recvPauser); ok {
+		p.PauseRecv()
+	}
+}
+
+// ResumeRecv continues receiving after PauseRecv.
+func (c *AsyncConn) ResumeRecv() {
+	if p, ok := c.tc.(recvPauser); ok {
+		p.ResumeRecv()
+	}
+}
+
 func (c *AsyncConn) Closed(err error) {
 	c.up.Closed(err)
 }